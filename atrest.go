@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"dfs/seal"
+)
+
+// ErrNoKey is returned when reading an object encrypted at rest from a
+// store that was opened without a keyring
+var ErrNoKey = errors.New("object is encrypted at rest and the store has no keyring")
+
+// seal returns what is stored for the plaintext read from r, the
+// encryption header followed by the sealed segments, and the id of the key
+// wrapping its data key
+func (s *Store) seal(r io.Reader) (io.Reader, uint32, error) {
+	hdr, dek, err := newEncHeader(s.Keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	c, err := hdr.cipher(dek)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.Encrypt(r, hdr.bytes(), 0), hdr.keyID(), nil
+}
+
+// reseal moves the object for key to the current key of the keyring. The
+// data key of an object encrypted at rest is wrapped again, an object
+// written before the store had a keyring is encrypted. Either way it stays
+// in the tier it is in and keeps its metadata.
+func (s *Store) reseal(key string) error {
+	if s.index.sealed(key) {
+		current, kek := s.Keys.Current()
+		return s.rewrap(key, func(h *encHeader, dek []byte) error {
+			// the first wrap is the one of the store, the others were granted
+			granted := slices.DeleteFunc(h.Wraps[1:], func(w keyWrap) bool {
+				return w.KeyID == current
+			})
+			h.Wraps = nil
+			if err := h.wrap(current, kek, dek); err != nil {
+				return err
+			}
+			h.Wraps = append(h.Wraps, granted...)
+			return nil
+		})
+	}
+
+	unlock := s.keys.lock(key)
+	defer unlock()
+
+	_, r, err := s.read(key, false)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	sealed, keyID, err := s.seal(r)
+	if err != nil {
+		return err
+	}
+
+	b, _ := s.locate(key)
+	n, err := b.Put(s.name(key), sealed)
+	if err != nil {
+		return err
+	}
+	return s.index.update(key, func(rec *indexRecord) bool {
+		rec.Size = n
+		rec.Sealed = true
+		rec.KeyID = keyID
+		return true
+	})
+}
+
+// Grant gives the holder of kek access to the object for key, which has
+// to be encrypted at rest, by wrapping its data key with kek under the
+// given id. Only the header of the object is written again.
+func (s *Store) Grant(key string, id uint32, kek []byte) error {
+	return s.rewrap(key, func(h *encHeader, dek []byte) error {
+		if id == h.keyID() {
+			return fmt.Errorf("key %d already wraps %s for the store", id, key)
+		}
+		return h.wrap(id, kek, dek)
+	})
+}
+
+// Revoke takes away the access Grant gave to the key with the given id
+func (s *Store) Revoke(key string, id uint32) error {
+	return s.rewrap(key, func(h *encHeader, dek []byte) error {
+		if id == h.keyID() {
+			return fmt.Errorf("key %d wraps %s for the store", id, key)
+		}
+		if !h.unwrapKey(id) {
+			return fmt.Errorf("%w %d for %s", ErrUnknownKey, id, key)
+		}
+		return nil
+	})
+}
+
+// rewrap changes the wraps of the data key of the object for key with fn,
+// the segments are copied over as they are
+func (s *Store) rewrap(key string, fn func(h *encHeader, dek []byte) error) error {
+	unlock := s.keys.lock(key)
+	defer unlock()
+
+	if !s.index.sealed(key) {
+		return fmt.Errorf("%s is not encrypted at rest", key)
+	}
+	if s.Keys == nil {
+		return ErrNoKey
+	}
+
+	b, _ := s.locate(key)
+	name := s.name(key)
+	_, r, err := b.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hdr, err := readEncHeader(r)
+	if err != nil {
+		return err
+	}
+	dek, err := hdr.dataKey(s.Keys)
+	if err != nil {
+		return err
+	}
+	if err := fn(hdr, dek); err != nil {
+		return err
+	}
+
+	n, err := b.Put(name, io.MultiReader(bytes.NewReader(hdr.bytes()), r))
+	if err != nil {
+		return err
+	}
+	return s.index.update(key, func(rec *indexRecord) bool {
+		rec.Size = n
+		rec.KeyID = hdr.keyID()
+		return true
+	})
+}
+
+// open opens the object for key wherever it lives and returns its size and
+// a reader over its plaintext. Objects written before the store had a key
+// are read as they are.
+func (s *Store) open(key string, touch bool) (int64, io.ReadCloser, error) {
+	s.claim(key)
+	key = s.resolve(key)
+	size, r, err := s.readTier(key, touch)
+	if err != nil || !s.index.sealed(key) {
+		return size, r, err
+	}
+	if s.Keys == nil {
+		r.Close()
+		return 0, nil, ErrNoKey
+	}
+
+	if ra, ok := r.(io.ReaderAt); ok {
+		sr, err := newSealedReaderAt(s.Keys, ra, size)
+		if err != nil {
+			r.Close()
+			return 0, nil, err
+		}
+		return sr.size, &sealedReadCloser{
+			Reader:   io.NewSectionReader(sr, 0, sr.size),
+			ReaderAt: sr,
+			Closer:   r,
+		}, nil
+	}
+
+	dr, hdr, err := NewDecryptingReader(s.Keys, r)
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	return hdr.plainSize(size), &limitReadCloser{Reader: dr, Closer: r}, nil
+}
+
+// sealedReadCloser reads the plaintext of an object encrypted at rest
+// from a backend that supports random access
+type sealedReadCloser struct {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// sealedReaderAt reads the plaintext of an encrypted file at any offset by
+// opening only the segments holding the bytes asked for
+type sealedReaderAt struct {
+	c   *seal.Cipher
+	hdr *encHeader
+	ra  io.ReaderAt
+	// sealed is the size of the encrypted file and size of its plaintext
+	sealed int64
+	size   int64
+}
+
+func newSealedReaderAt(keys *Keyring, ra io.ReaderAt, sealed int64) (*sealedReaderAt, error) {
+	hdr, err := readEncHeader(io.NewSectionReader(ra, 0, sealed))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: header cut off", ErrCiphertext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hdr.dataKey(keys)
+	if err != nil {
+		return nil, err
+	}
+	c, err := hdr.cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReaderAt{
+		c:      c,
+		hdr:    hdr,
+		ra:     ra,
+		sealed: sealed,
+		size:   hdr.plainSize(sealed),
+	}, nil
+}
+
+func (r *sealedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), r.size)
+	first, last := off/seal.SegmentSize, (end-1)/seal.SegmentSize
+
+	sealed := make([]byte, min(r.hdr.sealedOffset(last+1), r.sealed)-r.hdr.sealedOffset(first))
+	if _, err := r.ra.ReadAt(sealed, r.hdr.sealedOffset(first)); err != nil && err != io.EOF {
+		return 0, err
+	}
+	plain, err := r.c.Open(first, sealed)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, plain[min(off-first*seal.SegmentSize, int64(len(plain))):])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// backendReaderAt reads the object called name in b at any offset
+type backendReaderAt struct {
+	b    Backend
+	name string
+}
+
+func (r backendReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.b.ReadAt(r.name, p, off)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend is where a Store keeps the bytes of its objects. Objects are
+// named by the path the path transform of the store produces for their
+// key, an object that does not exist returns an error wrapping
+// os.ErrNotExist.
+type Backend interface {
+	// Put stores everything read from r under name, replacing what was
+	// stored before. The object appears all at once or not at all, when
+	// reading r fails nothing is stored.
+	Put(name string, r io.Reader) (int64, error)
+	// Get returns the size of the object and a reader over its bytes
+	Get(name string) (int64, io.ReadCloser, error)
+	Delete(name string) error
+	// Stat returns the size of the object
+	Stat(name string) (int64, error)
+	// List returns the names of every object starting with prefix in order
+	List(prefix string) ([]string, error)
+	ReadAt(name string, p []byte, offset int64) (int, error)
+}
+
+// FSBackend keeps every object in its own file in a folder structure below
+// its root, this is the layout a Store has always used
+type FSBackend struct {
+	root       string
+	durability Durability
+}
+
+func NewFSBackend(root string, durability Durability) *FSBackend {
+	return &FSBackend{
+		root:       root,
+		durability: durability,
+	}
+}
+
+func (b *FSBackend) path(name string) string {
+	return b.root + string(os.PathSeparator) + name
+}
+
+// Put writes r to a temporary file next to the final location of name and
+// only renames it into place once r is exhausted, so readers see either
+// the old or the new file and never a partial one
+func (b *FSBackend) Put(name string, r io.Reader) (int64, error) {
+	path := b.path(name)
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil && b.durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	if b.durability == DurabilityFull {
+		return n, syncDir(dir)
+	}
+	return n, nil
+}
+
+func (b *FSBackend) Get(name string) (int64, io.ReadCloser, error) {
+	f, err := os.Open(b.path(name))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), f, nil
+}
+
+func (b *FSBackend) Delete(name string) error {
+	return os.RemoveAll(b.path(name))
+}
+
+func (b *FSBackend) Stat(name string) (int64, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, os.ErrNotExist
+	}
+	return fi.Size(), nil
+}
+
+func (b *FSBackend) List(prefix string) ([]string, error) {
+	var names []string
+
+	err := filepath.WalkDir(b.root, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			//staging, quarantine and the like are not objects
+			if path != b.root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		name, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
+
+func (b *FSBackend) ReadAt(name string, p []byte, offset int64) (int, error) {
+	f, err := os.Open(b.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.ReadAt(p, offset)
+}
+
+// MemoryBackend keeps every object in memory, it is meant for tests
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string][]byte),
+	}
+}
+
+func (b *MemoryBackend) get(name string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	data, ok := b.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", name, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (b *MemoryBackend) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.objects[name] = data
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) Get(name string) (int64, io.ReadCloser, error) {
+	data, err := b.get(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(data)), &sectionReadCloser{
+		SectionReader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+		Closer:        io.NopCloser(nil),
+	}, nil
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.objects, name)
+	return nil
+}
+
+func (b *MemoryBackend) Stat(name string) (int64, error) {
+	data, err := b.get(name)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var names []string
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *MemoryBackend) ReadAt(name string, p []byte, offset int64) (int, error) {
+	data, err := b.get(name)
+	if err != nil {
+		return 0, err
+	}
+	return bytes.NewReader(data).ReadAt(p, offset)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+// cacheDir is the folder inside the storage root holding the cache
+const cacheDir = ".cache"
+
+// defaultCacheSize is the size of the cache when none is configured
+const defaultCacheSize = 256 << 20
+
+// cache holds the objects fetched from peers that this node is not
+// responsible for. It is a store of its own so cached objects never mix
+// with owned ones, and once it grows past maxBytes the least recently
+// used objects are evicted.
+type cache struct {
+	store    *Store
+	maxBytes int64
+
+	mu sync.Mutex
+	// lru holds the keys with the most recently used in front
+	lru   *list.List
+	elems map[string]*list.Element
+}
+
+// newCache opens the cache in store, what was cached before a restart is
+// ranked by when it was last fetched or served on this node
+func newCache(store *Store, maxBytes int64) *cache {
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheSize
+	}
+
+	c := &cache{
+		store:    store,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		elems:    make(map[string]*list.Element),
+	}
+
+	recs := store.index.records()
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Accessed.After(recs[j].Accessed)
+	})
+	for _, rec := range recs {
+		c.elems[rec.Meta.Key] = c.lru.PushBack(rec.Meta.Key)
+	}
+	c.evict("")
+	return c
+}
+
+// get returns the cached object for key and marks it as recently used
+func (c *cache) get(key string) (io.Reader, bool) {
+	c.mu.Lock()
+	elem, ok := c.elems[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	_, r, err := c.store.Read(key)
+	if err != nil {
+		log.Printf("dropping unreadable cached object %s: %s", key, err)
+		c.remove(key)
+		return nil, false
+	}
+	//kept in the index so the order survives a restart
+	if err := c.store.index.touch(key); err != nil {
+		log.Printf("recording the use of cached object %s: %s", key, err)
+	}
+	return r, true
+}
+
+func (c *cache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.elems[key]
+	return ok
+}
+
+// admit records that key was just put into the cache store and evicts
+// what no longer fits. The admitted object itself is kept even when it
+// is larger than the cache on its own.
+func (c *cache) admit(key string) {
+	c.mu.Lock()
+	if elem, ok := c.elems[key]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.elems[key] = c.lru.PushFront(key)
+	}
+	c.mu.Unlock()
+
+	c.evict(key)
+}
+
+func (c *cache) evict(keep string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.store.Capacity().Bytes > c.maxBytes {
+		elem := c.lru.Back()
+		if elem == nil || elem.Value.(string) == keep {
+			return
+		}
+		key := c.lru.Remove(elem).(string)
+		delete(c.elems, key)
+
+		if err := c.store.Delete(key); err != nil {
+			log.Printf("evicting cached object %s: %s", key, err)
+			return
+		}
+	}
+}
+
+func (c *cache) remove(key string) error {
+	c.mu.Lock()
+	if elem, ok := c.elems[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, key)
+	}
+	c.mu.Unlock()
+
+	return c.store.Delete(key)
+}
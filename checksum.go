@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// CorruptionError is returned when the bytes of an object no longer match
+// the checksum that was recorded when it was written
+type CorruptionError struct {
+	Key  string
+	Want []byte
+	Got  []byte
+	// Missing is set instead of the checksums when a range of the object
+	// came up short, it is the number of bytes missing from it
+	Missing int64
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Missing > 0 {
+		return fmt.Sprintf("object %s is corrupt: %d bytes of the range are missing", e.Key, e.Missing)
+	}
+	return fmt.Sprintf("object %s is corrupt: checksum %x, want %x", e.Key, e.Got, e.Want)
+}
+
+// hashFile returns the size and the sha256 checksum of the file at path
+func hashFile(path string) (int64, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, h.Sum(nil), nil
+}
+
+// verifyingReader hashes everything read through it and once the end of
+// the object is reached returns a CorruptionError instead of io.EOF when
+// the checksum does not match the recorded one
+type verifyingReader struct {
+	key  string
+	want []byte
+	r    io.ReadCloser
+	h    hash.Hash
+}
+
+func newVerifyingReader(key string, want []byte, r io.ReadCloser) *verifyingReader {
+	return &verifyingReader{
+		key:  key,
+		want: want,
+		r:    r,
+		h:    sha256.New(),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		if got := v.h.Sum(nil); !bytes.Equal(got, v.want) {
+			return n, &CorruptionError{Key: v.key, Want: v.want, Got: got}
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
@@ -0,0 +1,79 @@
+// Package client stores objects on dfs nodes encrypted with the key of the
+// user. Objects are encrypted before they are handed to a node and
+// decrypted after they come back, their names are hashed with the key, so
+// the nodes never see the plaintext nor the names of what they store.
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Storage is where a Client keeps its objects, the FileServer of a dfs
+// node is one
+type Storage interface {
+	Store(key string, r io.Reader) error
+	Get(key string) (io.Reader, error)
+	Delete(key string) error
+}
+
+// Client encrypts the objects it stores in a Storage
+type Client struct {
+	storage Storage
+	// names hashes the names of objects and data derives the keys of their
+	// contents, both come from the key of the user
+	names []byte
+	data  []byte
+}
+
+// New returns a client storing objects in storage encrypted with key, which
+// has to be 32 bytes
+func New(storage Storage, key []byte) (*Client, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key has %d bytes, want 32", len(key))
+	}
+	return &Client{
+		storage: storage,
+		names:   derive(key, "names"),
+		data:    derive(key, "data"),
+	}, nil
+}
+
+// Key returns the key the object called name is stored under
+func (c *Client) Key(name string) string {
+	return hex.EncodeToString(derive(c.names, name))
+}
+
+// Put encrypts what is read from r and stores it as the object called name
+func (c *Client) Put(name string, r io.Reader) error {
+	er, err := encrypt(c.data, name, r)
+	if err != nil {
+		return err
+	}
+	return c.storage.Store(c.Key(name), er)
+}
+
+// Get returns the decrypted object called name. Reading it fails with
+// ErrCiphertext once the object turns out to be tampered with.
+func (c *Client) Get(name string) (io.Reader, error) {
+	r, err := c.storage.Get(c.Key(name))
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(c.data, name, r)
+}
+
+// Delete deletes the object called name
+func (c *Client) Delete(name string) error {
+	return c.storage.Delete(c.Key(name))
+}
+
+// derive returns HMAC-SHA256 of label under key
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"dfs/seal"
+)
+
+// memStorage keeps objects in memory the way a node would see them
+type memStorage map[string][]byte
+
+func (m memStorage) Store(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	m[key] = b
+	return err
+}
+
+func (m memStorage) Get(key string) (io.Reader, error) {
+	b, ok := m[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (m memStorage) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func newKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	storage := memStorage{}
+	c, err := New(storage, newKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, seal.SegmentSize, 2*seal.SegmentSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := c.Put("myPrivateData", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		stored := storage[c.Key("myPrivateData")]
+		segments := max(1, (len(data)+seal.SegmentSize-1)/seal.SegmentSize)
+		if len(stored) != headerSize+len(data)+segments*seal.TagSize {
+			t.Errorf("%d bytes stored as %d", len(data), len(stored))
+		}
+		if size >= 16 && bytes.Contains(stored, data[:min(size, 64)]) {
+			t.Errorf("the storage holds the plaintext")
+		}
+
+		r, err := c.Get("myPrivateData")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%d bytes came back as %d (%v)", len(data), len(b), err)
+		}
+	}
+
+	for key := range storage {
+		if bytes.Contains([]byte(key), []byte("myPrivateData")) {
+			t.Errorf("the storage knows the name as %s", key)
+		}
+	}
+
+	if err := c.Delete("myPrivateData"); err != nil || len(storage) != 0 {
+		t.Errorf("delete left %d objects (%v)", len(storage), err)
+	}
+	if _, err := New(storage, []byte("short")); err == nil {
+		t.Errorf("a short key should be refused")
+	}
+}
+
+func TestClientDetectsTampering(t *testing.T) {
+	storage := memStorage{}
+	key := newKey()
+	c, _ := New(storage, key)
+
+	data := bytes.Repeat([]byte("tamper "), seal.SegmentSize/4)
+	if err := c.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	sealed := storage[c.Key("a")]
+
+	read := func(c *Client, name string, stored []byte) error {
+		storage[c.Key(name)] = stored
+		r, err := c.Get(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[headerSize+10] ^= 1
+	other, _ := New(storage, newKey())
+
+	cases := []struct {
+		name   string
+		client *Client
+		object string
+		stored []byte
+	}{
+		{"flipped bit", c, "a", flipped},
+		{"truncated", c, "a", sealed[:len(sealed)-1]},
+		{"dropped final segment", c, "a", sealed[:headerSize+seal.SegmentLength]},
+		{"header cut off", c, "a", sealed[:headerSize-1]},
+		{"stored under another name", c, "b", sealed},
+		{"another key", other, "a", sealed},
+	}
+	for _, tc := range cases {
+		if err := read(tc.client, tc.object, tc.stored); !errors.Is(err, ErrCiphertext) {
+			t.Errorf("%s: have %v want ErrCiphertext", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"dfs/seal"
+)
+
+// Objects start with a header followed by the plaintext sealed in segments
+// by package seal, the same way nodes encrypt what they push to each other.
+// The key of an object is derived from the key of the client and the
+// random salt in the header, the nonce prefix of its segments is the one
+// from the header. The header and the name of the object are the
+// additional data of every segment, so an object can't be passed off under
+// another name.
+//
+//	header:  magic "DFSC" | version | salt | nonce prefix
+const (
+	magic      = "DFSC"
+	version    = 1
+	saltSize   = 16
+	headerSize = len(magic) + 1 + saltSize + seal.PrefixSize
+)
+
+// ErrCiphertext is returned when an object fails to authenticate, it was
+// corrupted, tampered with, truncated or stored under another name
+var ErrCiphertext = seal.ErrCiphertext
+
+// header describes how an object was encrypted
+type header struct {
+	salt   [saltSize]byte
+	prefix [seal.PrefixSize]byte
+}
+
+func (h *header) bytes() []byte {
+	b := make([]byte, 0, headerSize)
+	b = append(b, magic...)
+	b = append(b, version)
+	b = append(b, h.salt[:]...)
+	return append(b, h.prefix[:]...)
+}
+
+func readHeader(r io.Reader) (*header, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: header cut off", ErrCiphertext)
+	}
+	if string(b[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not an encrypted object", ErrCiphertext)
+	}
+	if v := b[len(magic)]; v != version {
+		return nil, fmt.Errorf("unsupported encryption version %d", v)
+	}
+	h := &header{}
+	copy(h.salt[:], b[len(magic)+1:])
+	copy(h.prefix[:], b[len(magic)+1+saltSize:])
+	return h, nil
+}
+
+// cipher returns the cipher of the segments of the object called name
+// under the data key of the client
+func (h *header) cipher(data []byte, name string) (*seal.Cipher, error) {
+	return seal.New(derive(data, string(h.salt[:])), h.prefix, append(h.bytes(), name...))
+}
+
+// encrypt returns a reader yielding the header and the sealed segments of
+// the plaintext read from r
+func encrypt(data []byte, name string, r io.Reader) (io.Reader, error) {
+	h := &header{}
+	if _, err := io.ReadFull(rand.Reader, h.salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.prefix[:]); err != nil {
+		return nil, err
+	}
+	c, err := h.cipher(data, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.Encrypt(r, h.bytes(), 0), nil
+}
+
+// decrypt reads the header in front of src and returns a reader over the
+// plaintext of the object, it fails with ErrCiphertext as soon as a
+// segment does not authenticate and when the object ends before its final
+// segment
+func decrypt(data []byte, name string, src io.Reader) (io.Reader, error) {
+	h, err := readHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	c, err := h.cipher(data, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(src), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"math"
+
+	"dfs/seal"
+)
+
+// In convergent mode the data key and nonce prefix of a file are derived
+// from its plaintext, so identical files encrypt to identical bytes no
+// matter which node encrypts them and a node holding replicas of the same
+// file for several owners stores them once, see putShared. The plaintext
+// is hashed with HMAC under the cluster secret rather than with a plain
+// hash, so only members of the cluster can confirm a guess of the content
+// of a file. The data key is wrapped once, with a key
+// derived from the cluster secret, under convergentKeyID and the nonce of
+// the wrap is derived from the data key, which keeps the header identical
+// too. Every node holding the cluster secret can read such a file.
+const convergentKeyID = math.MaxUint32
+
+// newConvergentHeader reads the plaintext from r and returns the header and
+// data key it is encrypted with in convergent mode
+func newConvergentHeader(keys *Keyring, r io.Reader) (*encHeader, []byte, error) {
+	secret, err := keys.clusterSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	if _, err := io.Copy(mac, r); err != nil {
+		return nil, nil, err
+	}
+	tag := mac.Sum(nil)
+
+	h := &encHeader{
+		Version:     encVersion,
+		SegmentSize: seal.SegmentSize,
+	}
+	copy(h.Prefix[:], derive(tag, "prefix"))
+	dek := derive(tag, "data key")
+
+	var nonce [encNonceSize]byte
+	copy(nonce[:], derive(secret, "wrap nonce", dek))
+	if err := h.wrapNonce(convergentKeyID, derive(secret, "wrap key"), dek, nonce); err != nil {
+		return nil, nil, err
+	}
+	return h, dek, nil
+}
+
+// wrapKey returns the key encryption key with the given id, the key for
+// convergentKeyID is derived from the cluster secret
+func (k *Keyring) wrapKey(id uint32) ([]byte, error) {
+	if id != convergentKeyID {
+		return k.Key(id)
+	}
+	secret, err := k.clusterSecret()
+	if err != nil {
+		return nil, err
+	}
+	return derive(secret, "wrap key"), nil
+}
+
+// derive returns HMAC-SHA256 under key of label followed by data
+func derive(key []byte, label string, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
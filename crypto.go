@@ -1,12 +1,44 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"slices"
+
+	"dfs/seal"
+)
+
+// Encrypted files start with a header followed by the plaintext sealed in
+// segments by package seal, the nonce prefix of the segments is the random
+// one from the header.
+//
+// Every file is encrypted with a random data key of its own. The header
+// holds the data key wrapped by one or more key encryption keys, those are
+// keys of a keyring named by their id, so access to a single file can be
+// granted or revoked by changing its wraps without touching its segments.
+// The fixed part of the header up to the wraps is authenticated as the
+// additional data of every segment and of every wrap.
+//
+//	header:  magic "DFSE" | version | segment size uint32 | nonce prefix | wrap count uint8 | wraps
+//	wrap:    key id uint32 | nonce | sealed data key
+//	segment: sealed plaintext | 16 byte tag
+const (
+	encMagic     = "DFSE"
+	encVersion   = 3
+	encFixedSize = len(encMagic) + 1 + 4 + seal.PrefixSize + 1
+	encNonceSize = 12
+	encWrapSize  = 4 + encNonceSize + 32 + seal.TagSize
+	encMaxWraps  = 255
 )
 
+// ErrCiphertext is returned when encrypted data fails to authenticate, it
+// was corrupted, tampered with or truncated
+var ErrCiphertext = seal.ErrCiphertext
+
 func newEncryptionKey() []byte {
 
 	keyBuf := make([]byte, 32)
@@ -15,92 +47,290 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyDecrypt(key []byte, src io.Reader, dest io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
+// encHeader describes how a file was encrypted
+type encHeader struct {
+	Version     byte
+	SegmentSize uint32
+	Prefix      [seal.PrefixSize]byte
+	Wraps       []keyWrap
+}
+
+// keyWrap is the data key of a file sealed with the key KeyID
+type keyWrap struct {
+	KeyID   uint32
+	Nonce   [encNonceSize]byte
+	Wrapped []byte
+}
+
+// newEncHeader returns the header for a new file with a random prefix and
+// data key, the data key is wrapped with the current key of keys. It
+// returns the data key along with the header.
+func newEncHeader(keys *Keyring) (*encHeader, []byte, error) {
+	h := &encHeader{
+		Version:     encVersion,
+		SegmentSize: seal.SegmentSize,
+	}
+	if _, err := io.ReadFull(rand.Reader, h.Prefix[:]); err != nil {
+		return nil, nil, err
 	}
 
-	//read the iv
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
-		return 0, err
+	dek := newEncryptionKey()
+	id, kek := keys.Current()
+	if err := h.wrap(id, kek, dek); err != nil {
+		return nil, nil, err
+	}
+	return h, dek, nil
+}
+
+// ad is the part of the header authenticated along with every segment and
+// wrap, it leaves out the wraps so they can change
+func (h *encHeader) ad() []byte {
+	b := make([]byte, 0, encFixedSize-1)
+	b = append(b, encMagic...)
+	b = append(b, h.Version)
+	b = binary.BigEndian.AppendUint32(b, h.SegmentSize)
+	return append(b, h.Prefix[:]...)
+}
+
+func (h *encHeader) bytes() []byte {
+	b := make([]byte, 0, h.size())
+	b = append(b, h.ad()...)
+	b = append(b, byte(len(h.Wraps)))
+	for _, w := range h.Wraps {
+		b = binary.BigEndian.AppendUint32(b, w.KeyID)
+		b = append(b, w.Nonce[:]...)
+		b = append(b, w.Wrapped...)
+	}
+	return b
+}
+
+// size returns the length of the header in bytes
+func (h *encHeader) size() int {
+	return encFixedSize + len(h.Wraps)*encWrapSize
+}
+
+// encHeaderSize returns the length of the header that starts with the fixed
+// part in b
+func encHeaderSize(b []byte) (int, error) {
+	if len(b) < encFixedSize || string(b[:len(encMagic)]) != encMagic {
+		return 0, fmt.Errorf("%w: not an encrypted file", ErrCiphertext)
 	}
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dest)
-
-	// var (
-	// 	buf    = make([]byte, 1) // 32 * 1024 is size of io reader/writer buffer
-	// 	nw     = block.BlockSize()
-	// )
-
-	// for {
-	// 	n, err := src.Read(buf)
-	// 	if n > 0 {
-	// 		stream.XORKeyStream(buf, buf[:n])
-	// 		nWritten, err := dest.Write(buf)
-	// 		if err != nil {
-	// 			return 0, err
-	// 		}
-	// 		nw += nWritten
-	// 	}
-	// 	if err != nil {
-	// 		if err == io.EOF {
-	// 			break
-	// 		}
-	// 		return 0, err
-	// 	}
-	// }
-	// return nw, err
-}
-
-func copyEncrypt(key []byte, src io.Reader, dest io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	return encFixedSize + int(b[encFixedSize-1])*encWrapSize, nil
+}
+
+func parseEncHeader(b []byte) (*encHeader, error) {
+	size, err := encHeaderSize(b)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	if len(b) < size {
+		return nil, fmt.Errorf("%w: header cut off", ErrCiphertext)
+	}
+	b = b[len(encMagic):]
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return 0, err
+	h := &encHeader{
+		Version:     b[0],
+		SegmentSize: binary.BigEndian.Uint32(b[1:5]),
+	}
+	copy(h.Prefix[:], b[5:])
+	if h.Version != encVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", h.Version)
+	}
+	if h.SegmentSize != seal.SegmentSize {
+		return nil, fmt.Errorf("unsupported segment size %d", h.SegmentSize)
 	}
 
-	//prepend the iv to the file
-	if _, err := dest.Write(iv); err != nil {
-		return 0, err
+	wraps := b[encFixedSize-len(encMagic) : size-len(encMagic)]
+	for ; len(wraps) > 0; wraps = wraps[encWrapSize:] {
+		w := keyWrap{
+			KeyID:   binary.BigEndian.Uint32(wraps),
+			Wrapped: bytes.Clone(wraps[4+encNonceSize : encWrapSize]),
+		}
+		copy(w.Nonce[:], wraps[4:])
+		h.Wraps = append(h.Wraps, w)
+	}
+	return h, nil
+}
+
+func readEncHeader(r io.Reader) (*encHeader, error) {
+	b := make([]byte, encFixedSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size, err := encHeaderSize(b)
+	if err != nil {
+		return nil, err
 	}
+	b = append(b, make([]byte, size-encFixedSize)...)
+	if _, err := io.ReadFull(r, b[encFixedSize:]); err != nil {
+		return nil, err
+	}
+	return parseEncHeader(b)
+}
 
-	stream := cipher.NewCTR(block, iv)
-	// var (
-	// 	buf    = make([]byte, 32*1024) // 32 * 1024 is size of io reader/writer buffer
-	// 	nw     = block.BlockSize()
-	// )
-	return copyStream(stream, block.BlockSize(), src, dest)
+// wrapAD is the additional data of a wrap, it binds the wrap to the file
+// and to the id of its key
+func (h *encHeader) wrapAD(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(h.ad(), id)
+}
 
+// wrap adds the data key dek wrapped with kek under the given id, taking
+// the place of an earlier wrap with the same id
+func (h *encHeader) wrap(id uint32, kek, dek []byte) error {
+	var nonce [encNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	return h.wrapNonce(id, kek, dek, nonce)
 }
 
-func copyStream(stream cipher.Stream, blocksize int, src io.Reader, dest io.Writer) (int, error) {
+// wrapNonce is wrap with the nonce of the wrap given
+func (h *encHeader) wrapNonce(id uint32, kek, dek []byte, nonce [encNonceSize]byte) error {
+	aead, err := seal.NewAEAD(kek)
+	if err != nil {
+		return err
+	}
+	w := keyWrap{KeyID: id, Nonce: nonce}
+	w.Wrapped = aead.Seal(nil, w.Nonce[:], dek, h.wrapAD(id))
 
-	var (
-		buf = make([]byte, 32*1024) // 32 * 1024 is size of io reader/writer buffer
-		nw  = blocksize
-	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dest.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw = nw + nn
+	h.unwrapKey(id)
+	if len(h.Wraps) == encMaxWraps {
+		return errors.New("too many wraps")
+	}
+	h.Wraps = append(h.Wraps, w)
+	return nil
+}
+
+// unwrapKey drops the wrap with the given id and reports whether there was one
+func (h *encHeader) unwrapKey(id uint32) bool {
+	n := len(h.Wraps)
+	h.Wraps = slices.DeleteFunc(h.Wraps, func(w keyWrap) bool {
+		return w.KeyID == id
+	})
+	return len(h.Wraps) < n
+}
+
+// dataKey returns the data key of the file, opened with the first key of
+// keys that has a wrap in the header
+func (h *encHeader) dataKey(keys *Keyring) ([]byte, error) {
+	err := fmt.Errorf("%w: no key of the keyring wraps the data key", ErrUnknownKey)
+	for _, w := range h.Wraps {
+		kek, kerr := keys.wrapKey(w.KeyID)
+		if kerr != nil {
+			continue
 		}
-		if err == io.EOF {
-			return 0, err
+		aead, kerr := seal.NewAEAD(kek)
+		if kerr != nil {
+			return nil, kerr
 		}
-		if err != nil {
-			return 0, err
+		dek, kerr := aead.Open(nil, w.Nonce[:], w.Wrapped, h.wrapAD(w.KeyID))
+		if kerr == nil {
+			return dek, nil
 		}
+		// ids are only unique within a keyring, a wrap for a key of
+		// another keyring can carry the same id
+		err = fmt.Errorf("%w: data key wrapped with key %d", ErrCiphertext, w.KeyID)
+	}
+	return nil, err
+}
+
+// keyID returns the id of the key the file was first wrapped with
+func (h *encHeader) keyID() uint32 {
+	if len(h.Wraps) == 0 {
+		return 0
+	}
+	return h.Wraps[0].KeyID
+}
+
+// cipher returns the cipher of the segments of the file with the data key
+// dek
+func (h *encHeader) cipher(dek []byte) (*seal.Cipher, error) {
+	return seal.New(dek, h.Prefix, h.ad())
+}
+
+// sealedSize returns the size of a file of size bytes once encrypted,
+// header included
+func (h *encHeader) sealedSize(size int64) int64 {
+	return int64(h.size()) + seal.SealedSize(size)
+}
+
+// plainSize returns the size of the plaintext of an encrypted file of size
+// bytes, header included
+func (h *encHeader) plainSize(size int64) int64 {
+	return seal.PlainSize(size - int64(h.size()))
+}
+
+// sealedOffset returns where segment starts in an encrypted file
+func (h *encHeader) sealedOffset(segment int64) int64 {
+	return int64(h.size()) + segment*seal.SegmentLength
+}
+
+// newEncryptReader yields the sealed segments of the plaintext read from r,
+// which holds the plaintext from the start of segment onwards. The header
+// is not part of its output.
+func newEncryptReader(key []byte, hdr *encHeader, r io.Reader, segment int64) (io.Reader, error) {
+	c, err := hdr.cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Encrypt(r, nil, segment), nil
+}
+
+// NewDecryptingReader reads the header in front of src and returns a reader
+// over the rest of src decrypted with the data key, which is unwrapped with
+// keys, together with the header
+func NewDecryptingReader(keys *Keyring, src io.Reader) (*seal.DecryptingReader, *encHeader, error) {
+	hdr, err := readEncHeader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hdr.dataKey(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := hdr.cipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.NewReader(src), hdr, nil
+}
+
+// NewEncryptingWriter returns a writer encrypting into w with a fresh data
+// key wrapped by the current key of keys, the header is written in front
+// of the segments
+func NewEncryptingWriter(keys *Keyring, w io.Writer) (*seal.EncryptingWriter, error) {
+	hdr, key, err := newEncHeader(keys)
+	if err != nil {
+		return nil, err
+	}
+	c, err := hdr.cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewWriter(w, hdr.bytes()), nil
+}
+
+// copyEncrypt writes src encrypted with a fresh data key wrapped by the
+// current key of keys to dest and returns the number of bytes written
+func copyEncrypt(keys *Keyring, src io.Reader, dest io.Writer) (int, error) {
+	ew, err := NewEncryptingWriter(keys, dest)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(ew, src); err != nil {
+		return int(ew.Written()), err
+	}
+	err = ew.Close()
+	return int(ew.Written()), err
+}
+
+// copyDecrypt writes the decrypted src to dest and returns the number of
+// bytes written
+func copyDecrypt(keys *Keyring, src io.Reader, dest io.Writer) (int, error) {
+	dr, _, err := NewDecryptingReader(keys, src)
+	if err != nil {
+		return 0, err
 	}
-	return nw, nil
+	n, err := io.Copy(dest, dr)
+	return int(n), err
 }
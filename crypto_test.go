@@ -2,9 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
 	"testing"
+
+	"dfs/seal"
 )
 
 // func TestNewEncryptionKey(t *testing.T) {
@@ -21,9 +28,9 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	src := bytes.NewReader([]byte(originalText))
 
 	dest := new(bytes.Buffer)
-	key := newEncryptionKey()
+	keys := newKeyring()
 
-	_, err := copyEncrypt(key, src, dest)
+	_, err := copyEncrypt(keys, src, dest)
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -33,20 +40,20 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	// fmt.Println("Encrypted text: ", dest.String())
 	out := new(bytes.Buffer)
 
-	nw, err := copyDecrypt(key, dest, out)
+	nw, err := copyDecrypt(keys, dest, out)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if nw != 16+len(originalText) {
-		t.Fail()
+	if nw != len(originalText) {
+		t.Errorf("decrypting wrote %d bytes, want %d", nw, len(originalText))
 	}
 
-	if strings.EqualFold(originalText, out.String()) {
+	if strings.EqualFold(originalText, dest.String()) {
 		t.Errorf("%s encrypted gave %s", originalText, dest.String())
 	}
 
-	if strings.EqualFold(originalText, out.String()) {
+	if !strings.EqualFold(originalText, out.String()) {
 		t.Errorf("%s encrypted and decrypted gave %s", originalText, out.String())
 	}
 
@@ -54,3 +61,271 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	// fmt.Println("Decrypted text", out.String())
 
 }
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	keys := newKeyring()
+	plain := make([]byte, 2*seal.SegmentSize+100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys, bytes.NewReader(plain), enc); err != nil {
+		t.Fatal(err)
+	}
+	sealed := enc.Bytes()
+	hdr, err := parseEncHeader(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sealed)) != hdr.sealedSize(int64(len(plain))) {
+		t.Errorf("have %d encrypted bytes want %d", len(sealed), hdr.sealedSize(int64(len(plain))))
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[hdr.sealedOffset(1)+10] ^= 1
+	header := bytes.Clone(sealed)
+	header[encFixedSize-2] ^= 1
+	wrap := bytes.Clone(sealed)
+	wrap[hdr.size()-1] ^= 1
+	dropped := append(bytes.Clone(sealed[:hdr.sealedOffset(1)]), sealed[hdr.sealedOffset(2):]...)
+
+	tests := map[string][]byte{
+		"flipped bit":       flipped,
+		"truncated":         sealed[:hdr.sealedOffset(2)],
+		"tampered wrap":     wrap,
+		"dropped segment":   dropped,
+		"trailing data":     append(bytes.Clone(sealed), 0),
+		"tampered header":   header,
+		"missing final tag": sealed[:len(sealed)-1],
+	}
+	for name, b := range tests {
+		_, err := copyDecrypt(keys, bytes.NewReader(b), io.Discard)
+		if !errors.Is(err, ErrCiphertext) {
+			t.Errorf("%s: have error %v want %v", name, err, ErrCiphertext)
+		}
+	}
+
+	if _, err := copyDecrypt(newKeyring(), bytes.NewReader(sealed), io.Discard); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("decrypting with the wrong key: have error %v want %v", err, ErrCiphertext)
+	}
+
+	empty := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys, bytes.NewReader(nil), empty); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyDecrypt(keys, bytes.NewReader(empty.Bytes()[:hdr.size()]), io.Discard); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("an empty file without its final segment should not decrypt")
+	}
+	if n, err := copyDecrypt(keys, empty, io.Discard); err != nil || n != 0 {
+		t.Errorf("decrypting an empty file gave %d, %v", n, err)
+	}
+}
+
+func TestEncryptingWriter(t *testing.T) {
+	keys := newKeyring()
+
+	for _, size := range []int{0, 1, seal.SegmentSize, 2*seal.SegmentSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		// odd write sizes so segments are filled across writes
+		enc := new(bytes.Buffer)
+		ew, err := NewEncryptingWriter(keys, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nw int
+		for rest := data; len(rest) > 0; {
+			n, err := ew.Write(rest[:min(len(rest), 1000)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			nw += n
+			rest = rest[n:]
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ew.Close(); err != nil {
+			t.Errorf("closing twice: %v", err)
+		}
+		if _, err := ew.Write([]byte("late")); err == nil {
+			t.Errorf("writing after Close should fail")
+		}
+
+		// a fresh header holds the one wrap of the current key
+		hdr := &encHeader{Wraps: make([]keyWrap, 1)}
+		if nw != size || ew.Written() != int64(enc.Len()) || ew.Written() != hdr.sealedSize(int64(size)) {
+			t.Errorf("size %d: wrote %d plaintext and %d sealed bytes, buffer holds %d", size, nw, ew.Written(), enc.Len())
+		}
+
+		dr, _, err := NewDecryptingReader(keys, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		if n, err := io.Copy(out, dr); err != nil || n != int64(size) || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("size %d: decrypted %d bytes (%v)", size, n, err)
+		}
+	}
+}
+
+func TestOpenSegments(t *testing.T) {
+	keys := newKeyring()
+	plain := make([]byte, 3*seal.SegmentSize+5)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys, bytes.NewReader(plain), enc); err != nil {
+		t.Fatal(err)
+	}
+	sealed := enc.Bytes()
+	hdr, err := parseEncHeader(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := hdr.dataKey(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := hdr.cipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for first := int64(0); first < 4; first++ {
+		out, err := c.Open(first, sealed[hdr.sealedOffset(first):])
+		if err != nil {
+			t.Fatalf("opening from segment %d: %s", first, err)
+		}
+		if !bytes.Equal(out, plain[first*seal.SegmentSize:]) {
+			t.Errorf("opening from segment %d gave the wrong plaintext", first)
+		}
+	}
+
+	inner, err := c.Open(1, sealed[hdr.sealedOffset(1):hdr.sealedOffset(2)])
+	if err != nil || !bytes.Equal(inner, plain[seal.SegmentSize:2*seal.SegmentSize]) {
+		t.Errorf("opening a single inner segment gave %v", err)
+	}
+	if _, err := c.Open(2, sealed[hdr.sealedOffset(1):hdr.sealedOffset(2)]); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("a segment opened at the wrong position should fail, have %v", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	// RFC 7914 section 11
+	want, _ := hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+	if got, err := masterKey(KeyringOpts{Passphrase: "passwd"}, []byte("salt"), 1); err != nil || !bytes.Equal(got, want[:32]) {
+		t.Errorf("the passphrase gave the master key %x want %x (%v)", got, want[:32], err)
+	}
+
+	t.Setenv(envMasterKey, "")
+	t.Setenv(envPassphrase, "")
+
+	path := t.TempDir() + "/keyring"
+	if _, err := OpenKeyring(KeyringOpts{Path: path}); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("have error %v want %v", err, ErrNoMasterKey)
+	}
+
+	keys, err := OpenKeyring(KeyringOpts{Path: path, Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys, strings.NewReader("kept across restarts"), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenKeyring(KeyringOpts{Path: path, Passphrase: "wrong horse"}); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("have error %v want %v", err, ErrWrongMasterKey)
+	}
+
+	t.Setenv(envPassphrase, "correct horse")
+	reopened, err := OpenKeyring(KeyringOpts{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(reopened, enc, out); err != nil || out.String() != "kept across restarts" {
+		t.Errorf("decrypting with the reopened keyring gave %q (%v)", out, err)
+	}
+
+	if _, err := newKeyring().Key(2); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("have error %v want %v", err, ErrUnknownKey)
+	}
+
+	// rotated keys survive a restart and ids of retired keys are not reused
+	id, err := reopened.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Retire(id); err == nil {
+		t.Errorf("the current key should not be retired")
+	}
+	if err := reopened.Retire(1); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = OpenKeyring(KeyringOpts{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := reopened.Current(); current != id || !slices.Equal(reopened.IDs(), []uint32{id}) {
+		t.Errorf("have keys %v current %d after reopening", reopened.IDs(), current)
+	}
+	if next, err := reopened.Rotate(); err != nil || next != id+1 {
+		t.Errorf("have id %d (%v) want %d", next, err, id+1)
+	}
+}
+
+func TestConvergentEncryption(t *testing.T) {
+	secret := []byte("shared by the cluster")
+	encrypt := func(keys *Keyring, data []byte) []byte {
+		t.Helper()
+		hdr, dek, err := newConvergentHeader(keys, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		er, err := newEncryptReader(dek, hdr, bytes.NewReader(data), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(er)
+		return append(hdr.bytes(), body...)
+	}
+
+	// two nodes with keyrings of their own and the same cluster secret
+	k1, k2 := newKeyring(), newKeyring()
+	k1.cluster, k2.cluster = secret, secret
+
+	data := bytes.Repeat([]byte("identical content "), seal.SegmentSize/8)
+	c1, c2 := encrypt(k1, data), encrypt(k2, data)
+	if !bytes.Equal(c1, c2) {
+		t.Fatalf("the same content encrypted to different bytes")
+	}
+	if bytes.Equal(c1, encrypt(k1, append(data, '!'))) {
+		t.Errorf("different content encrypted to the same bytes")
+	}
+
+	other := newKeyring()
+	other.cluster = []byte("another cluster")
+	if bytes.Equal(c1, encrypt(other, data)) {
+		t.Errorf("the encryption should depend on the cluster secret")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(k2, bytes.NewReader(c1), out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("decrypting on another node of the cluster failed: %v", err)
+	}
+	if _, err := copyDecrypt(other, bytes.NewReader(c1), io.Discard); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("decrypting with another cluster secret gave %v, want ErrCiphertext", err)
+	}
+	if _, err := copyDecrypt(newKeyring(), bytes.NewReader(c1), io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("decrypting without a cluster secret gave %v, want ErrUnknownKey", err)
+	}
+	if _, _, err := newConvergentHeader(newKeyring(), bytes.NewReader(data)); !errors.Is(err, ErrNoClusterSecret) {
+		t.Errorf("encrypting without a cluster secret gave %v, want ErrNoClusterSecret", err)
+	}
+}
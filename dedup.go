@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Replicas pushed in convergent mode are identical no matter which node
+// owns them, so a node holding replicas of the same file for several
+// owners keeps its bytes once. The bytes are stored as a blob named after
+// their checksum and every replica is an entry of the index pointing at
+// it. The blob is removed together with the last replica sharing it.
+
+// blobPrefix starts the key of every blob
+const blobPrefix = "blob:"
+
+// blobKey returns the key of the blob holding the bytes with checksum sum
+func blobKey(sum []byte) string {
+	return blobPrefix + hex.EncodeToString(sum)
+}
+
+// isBlobKey reports whether key is the key of a blob
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobPrefix)
+}
+
+// resolve returns the key of the object holding the bytes of key
+func (s *Store) resolve(key string) string {
+	if blob := s.index.blob(key); blob != "" {
+		return blob
+	}
+	return key
+}
+
+// putShared stores everything read from r, which has to match the
+// checksum want, as the replica described by meta. The bytes go to the
+// blob for want unless it exists already, the replica only records that
+// it shares them.
+func (s *Store) putShared(meta *Metadata, want []byte, r io.Reader) (int64, error) {
+	blob := blobKey(want)
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	if !s.index.has(blob) {
+		if _, err := s.put(&Metadata{Key: blob}, want, r, nil); err != nil {
+			return 0, err
+		}
+	}
+	stored, ok := s.index.get(blob)
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+
+	unlock := s.keys.lock(meta.Key)
+	var (
+		old, _ = s.locate(meta.Key)
+		shared = s.index.blob(meta.Key)
+		owned  = s.index.has(meta.Key) && shared == ""
+	)
+	if meta.ContentType == "" {
+		meta.ContentType = stored.ContentType
+	}
+	s.prepare(meta, stored.Size, stored.Checksum, nil)
+	err := s.index.put(&indexRecord{Accessed: time.Now(), Blob: blob, Meta: *meta})
+	if err == nil && owned {
+		//the replica used to have bytes of its own
+		if err := old.Delete(s.name(meta.Key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("removing %s now stored as %s: %s", meta.Key, blob, err)
+		}
+	}
+	unlock()
+
+	if err != nil {
+		return 0, errors.Join(err, s.deleteBlob(blob))
+	}
+	if shared != "" && shared != blob {
+		if err := s.deleteBlob(shared); err != nil {
+			log.Printf("removing %s: %s", shared, err)
+		}
+	}
+	return stored.Size, nil
+}
+
+// release removes blob once no entry shares it anymore
+func (s *Store) release(blob string) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	return s.deleteBlob(blob)
+}
+
+// deleteBlob is release, it has to be called with the blob lock held
+func (s *Store) deleteBlob(blob string) error {
+	if s.index.shared(blob) > 0 {
+		return nil
+	}
+	return s.Delete(blob)
+}
+
+// removeUnsharedBlobs deletes the blobs no entry shares, as left by a
+// crash between writing a blob and recording the replica sharing it
+func (s *Store) removeUnsharedBlobs() error {
+	blobs, _ := s.index.page(blobPrefix, "", 0)
+	for _, blob := range blobs {
+		if err := s.release(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convergent reports whether the staged file is encrypted in convergent
+// mode
+func (sf *StagedFile) Convergent() bool {
+	hdr, err := readEncHeader(io.NewSectionReader(sf.file, 0, sf.Size))
+	return err == nil && hdr.keyID() == convergentKeyID
+}
+
+// PublishShared stores the staged file as a replica with meta as its
+// metadata, sharing its bytes with the replicas that have the same ones,
+// see putShared. The staged file has to match want.
+func (sf *StagedFile) PublishShared(want []byte, meta Metadata) error {
+	if _, err := sf.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	meta.Key = sf.Key
+	_, err := sf.store.putShared(&meta, want, sf.file)
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) {
+		sf.Discard()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	return sf.Discard()
+}
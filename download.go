@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+
+	"dfs/p2p"
+)
+
+// pieceSize is the size of the chunks a file is split into when it is
+// downloaded from several replicas at the same time
+const pieceSize = 64 * 1024
+
+// maxFileSize is the largest file that is transferred, it bounds what is
+// allocated for the pieces of a file before any of it arrived
+const maxFileSize = 64 << 30
+
+// maxPieceAttempts is how many times a single piece is requested from
+// different peers before the whole download is given up
+const maxPieceAttempts = 3
+
+// manifest describes a file as it is stored on a peer, the size and the
+// sha256 checksum of the file and the sha256 hash of every piece in order
+type manifest struct {
+	Size     int64
+	Checksum [sha256.Size]byte
+	Pieces   [][sha256.Size]byte
+	// Meta is the metadata the peer holds for the file, it is not part of
+	// the fingerprint
+	Meta Metadata
+}
+
+func numPieces(size int64) int64 {
+	return (size + pieceSize - 1) / pieceSize
+}
+
+// pieceLen returns the length of piece i of a file with the given size,
+// only the last piece can be shorter than pieceSize
+func pieceLen(size, i int64) int64 {
+	if rest := size - i*pieceSize; rest < pieceSize {
+		return rest
+	}
+	return pieceSize
+}
+
+// fingerprint identifies a manifest so that manifests received from
+// different peers can be compared
+func (m *manifest) fingerprint() [sha256.Size]byte {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, m.Size)
+	h.Write(m.Checksum[:])
+	for _, p := range m.Pieces {
+		h.Write(p[:])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+type pieceResult struct {
+	index int64
+	peer  p2p.Peer
+	data  []byte
+	err   error
+}
+
+// download fetches the file for key from the peers holding a replica and
+// decrypts it into the cache
+func (fs *FileServer) download(key string) (int64, error) {
+	sf, m, err := fs.fetch(fs.cache.store, key, fs.wireKey(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	meta, err := fs.openMeta(&m.Meta)
+	if err != nil {
+		sf.Close()
+		return 0, err
+	}
+
+	n, err := sf.PublishDecrypt(fs.keys, nil, *meta)
+	if err != nil {
+		sf.Close()
+		return 0, err
+	}
+	fs.cache.admit(key)
+	return n, nil
+}
+
+// fetch downloads the file for key, called wire on the peers, as the peers
+// store it into the staging area of st and returns it unpublished. Peers
+// are first asked for their manifest, the manifest whose checksum is want
+// or else the one most peers agree on is used and its pieces are requested
+// concurrently, one outstanding piece per peer. Every piece is verified
+// against the manifest hash and a failed piece is retried on another peer.
+func (fs *FileServer) fetch(st *Store, key, wire string, want []byte) (*StagedFile, *manifest, error) {
+	peers := fs.peerList()
+	if len(peers) == 0 {
+		return nil, nil, fmt.Errorf("[%s] no peers to fetch %s from", fs.Transport.Addr(), key)
+	}
+
+	m, sources := fs.collectManifests(wire, peers, want)
+	if m == nil {
+		return nil, nil, fmt.Errorf("[%s] no peer has file %s", fs.Transport.Addr(), key)
+	}
+
+	fp := m.fingerprint()
+	sf, err := st.Stage(key, hex.EncodeToString(fp[:]), m.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := fs.fetchPieces(sf, m, wire, sources); err != nil {
+		// the verified pieces stay in staging, the next fetch of the same
+		// content only requests what is missing
+		sf.Close()
+		return nil, nil, err
+	}
+
+	sum, err := sf.Checksum()
+	if err != nil {
+		sf.Close()
+		return nil, nil, err
+	}
+	if !bytes.Equal(sum, m.Checksum[:]) {
+		sf.Discard()
+		return nil, nil, &CorruptionError{Key: key, Want: m.Checksum[:], Got: sum}
+	}
+
+	log.Printf("[%s] fetched %s (%d bytes) from %d peers", fs.Transport.Addr(), key, m.Size, len(sources))
+	return sf, m, nil
+}
+
+// fetchPieces requests every piece of m not yet staged in sf from sources,
+// which know the file as wire
+func (fs *FileServer) fetchPieces(sf *StagedFile, m *manifest, wire string, sources []p2p.Peer) error {
+	key := sf.Key
+
+	var (
+		pending  = make([]int64, 0, len(m.Pieces))
+		attempts = make([]int, len(m.Pieces))
+		idle     = sources
+		inflight = 0
+		// buffered so that in flight requests never block once we bail out
+		results = make(chan pieceResult, len(sources))
+	)
+	for i := range m.Pieces {
+		if !sf.Pieces[i] {
+			pending = append(pending, int64(i))
+		}
+	}
+	if resumed := len(m.Pieces) - len(pending); resumed > 0 {
+		log.Printf("[%s] resuming download of %s, %d of %d pieces already staged", fs.Transport.Addr(), key, resumed, len(m.Pieces))
+	}
+
+	for len(pending) > 0 || inflight > 0 {
+		for len(pending) > 0 && len(idle) > 0 {
+			index, peer := pending[0], idle[0]
+			pending, idle = pending[1:], idle[1:]
+			inflight++
+
+			go func() {
+				data, err := fs.requestRange(peer, wire, index*pieceSize, pieceLen(m.Size, index))
+				if err == nil && int64(len(data)) != pieceLen(m.Size, index) {
+					err = fmt.Errorf("got %d bytes want %d", len(data), pieceLen(m.Size, index))
+				}
+				results <- pieceResult{index: index, peer: peer, data: data, err: err}
+			}()
+		}
+
+		if inflight == 0 {
+			return fmt.Errorf("[%s] ran out of peers while fetching %s", fs.Transport.Addr(), key)
+		}
+
+		res := <-results
+		inflight--
+
+		if res.err == nil && sha256.Sum256(res.data) != m.Pieces[res.index] {
+			res.err = fmt.Errorf("hash mismatch")
+		}
+		if res.err != nil {
+			// the peer is not used again for this download, the piece is
+			// put back so another peer can serve it
+			log.Printf("[%s] piece %d of %s from %s failed: %s", fs.Transport.Addr(), res.index, key, res.peer.RemoteAddr(), res.err)
+			attempts[res.index]++
+			if attempts[res.index] >= maxPieceAttempts {
+				return fmt.Errorf("[%s] giving up on piece %d of %s", fs.Transport.Addr(), res.index, key)
+			}
+			pending = append(pending, res.index)
+			continue
+		}
+
+		if _, err := sf.WriteAt(res.data, res.index*pieceSize); err != nil {
+			return err
+		}
+		sf.Pieces[res.index] = true
+		if err := sf.Checkpoint(); err != nil {
+			return err
+		}
+		idle = append(idle, res.peer)
+	}
+
+	return nil
+}
+
+// collectManifests asks every peer for its manifest of key and returns the
+// manifest with checksum want, or when no peer has that the manifest the
+// most peers agree on, together with the peers that sent it
+func (fs *FileServer) collectManifests(key string, peers []p2p.Peer, want []byte) (*manifest, []p2p.Peer) {
+	type reply struct {
+		peer p2p.Peer
+		m    *manifest
+	}
+
+	replies := make(chan reply, len(peers))
+	for _, peer := range peers {
+		go func(peer p2p.Peer) {
+			m, err := fs.requestManifest(peer, key)
+			if err != nil {
+				log.Printf("[%s] manifest of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			}
+			replies <- reply{peer: peer, m: m}
+		}(peer)
+	}
+
+	var (
+		votes  = make(map[[sha256.Size]byte][]p2p.Peer)
+		byHash = make(map[[sha256.Size]byte]*manifest)
+		best   [sha256.Size]byte
+	)
+	for range peers {
+		r := <-replies
+		if r.m == nil {
+			continue
+		}
+		fp := r.m.fingerprint()
+		votes[fp] = append(votes[fp], r.peer)
+		byHash[fp] = r.m
+		if len(votes[fp]) > len(votes[best]) {
+			best = fp
+		}
+	}
+
+	for fp, m := range byHash {
+		if want != nil && bytes.Equal(m.Checksum[:], want) {
+			return m, votes[fp]
+		}
+	}
+
+	return byHash[best], votes[best]
+}
+
+// requestManifest asks peer for the manifest of key, a nil manifest is
+// returned when the peer does not have the file
+func (fs *FileServer) requestManifest(peer p2p.Peer, key string) (*manifest, error) {
+	msg := Message{
+		Payload: MessageGetManifest{
+			Key: key,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var size int64
+	if err := binary.Read(peer, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	if size == -1 {
+		return nil, readFailure(peer)
+	}
+	if size < 0 || size > maxFileSize {
+		//the rest of the reply can't be told apart from what follows it
+		peer.Close()
+		return nil, fmt.Errorf("peer sent the manifest of a file of %d bytes", size)
+	}
+
+	m := &manifest{
+		Size:   size,
+		Pieces: make([][sha256.Size]byte, numPieces(size)),
+	}
+	if _, err := io.ReadFull(peer, m.Checksum[:]); err != nil {
+		return nil, err
+	}
+	for i := range m.Pieces {
+		if _, err := io.ReadFull(peer, m.Pieces[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := readFrame(peer, &m.Meta); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// requestRange asks peer for length bytes of key starting at offset and
+// reads them from the connection. A peer that does not have the file
+// answers with an empty range
+func (fs *FileServer) requestRange(peer p2p.Peer, key string, offset, length int64) ([]byte, error) {
+	msg := Message{
+		Payload: MessageGetFile{
+			Key:    key,
+			Offset: offset,
+			Length: length,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var n int64
+	if err := binary.Read(peer, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		return nil, readFailure(peer)
+	}
+	if n < 0 || (length > 0 && n > length) {
+		//the rest of the reply can't be told apart from what follows it
+		peer.Close()
+		return nil, fmt.Errorf("peer sent %d bytes for a range of %d", n, length)
+	}
+
+	if length == 0 {
+		//up to the end of the file, which is only held once it arrived
+		buf := new(bytes.Buffer)
+		if _, err := io.CopyN(buf, peer, n); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (fs *FileServer) handleMessageGetManifest(from string, msg MessageGetManifest) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(p2p.IncomingStream)
+
+	if !fs.store.Has(msg.Key) {
+		binary.Write(buf, binary.LittleEndian, int64(0))
+		return fs.write(peer, buf.Bytes())
+	}
+
+	size, r, err := fs.store.Read(msg.Key)
+	if err != nil {
+		fs.sendManifestFailure(peer, err)
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	var (
+		h      = sha256.New()
+		piece  = make([]byte, pieceSize)
+		hashes = new(bytes.Buffer)
+	)
+	for i := int64(0); i < numPieces(size); i++ {
+		n, err := io.ReadFull(r, piece[:pieceLen(size, i)])
+		if err != nil {
+			// the peer is already waiting on the stream, so it has to be
+			// told the request failed
+			fs.sendManifestFailure(peer, err)
+			return err
+		}
+		h.Write(piece[:n])
+		sum := sha256.Sum256(piece[:n])
+		hashes.Write(sum[:])
+	}
+	// reading up to the end has the store check the file against its
+	// recorded checksum, a corrupt file is not handed out
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		fs.sendManifestFailure(peer, err)
+		return err
+	}
+
+	meta, err := fs.store.Stat(msg.Key)
+	if err != nil {
+		fs.sendManifestFailure(peer, err)
+		return err
+	}
+
+	binary.Write(buf, binary.LittleEndian, size)
+	buf.Write(h.Sum(nil))
+	buf.Write(hashes.Bytes())
+	writeFrame(buf, meta)
+
+	return fs.write(peer, buf.Bytes())
+}
+
+// sendManifestFailure answers a request for a manifest with the error it
+// failed with
+func (fs *FileServer) sendManifestFailure(peer p2p.Peer, err error) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(p2p.IncomingStream)
+	binary.Write(buf, binary.LittleEndian, int64(-1))
+	writeFrame(buf, err.Error())
+	return fs.write(peer, buf.Bytes())
+}
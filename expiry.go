@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// defaultReapInterval is how often expired objects are looked for when no
+// interval is configured
+const defaultReapInterval = time.Minute
+
+// MessageDeleteFile tells a peer to delete the object for Key
+type MessageDeleteFile struct {
+	Key string
+}
+
+// expired reports whether the object has expired at now
+func (m *Metadata) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// Expired returns the metadata of every object that has expired at now
+func (s *Store) Expired(now time.Time) []*Metadata {
+	var metas []*Metadata
+	for _, meta := range s.index.all() {
+		if meta.expired(now) {
+			metas = append(metas, meta)
+		}
+	}
+	return metas
+}
+
+// StoreWithTTL stores the object for key like Store, the object expires
+// after ttl on every node holding it
+func (fs *FileServer) StoreWithTTL(key string, ttl time.Duration, r io.Reader) error {
+	return fs.StoreWithMetadata(Metadata{Key: key, Expires: time.Now().Add(ttl)}, r)
+}
+
+// Delete deletes the object for key from the local disk and the cache and
+// tells every peer to do the same
+func (fs *FileServer) Delete(key string) error {
+	fs.pendingLock.Lock()
+	for _, uploads := range fs.pending {
+		delete(uploads, key)
+	}
+	fs.pendingLock.Unlock()
+
+	if err := fs.store.Delete(key); err != nil {
+		return err
+	}
+	fs.readvertise()
+	if err := fs.cache.remove(key); err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageDeleteFile{Key: fs.wireKey(key)},
+	}
+	for _, peer := range fs.peerList() {
+		if err := fs.send(peer, &msg); err != nil {
+			log.Printf("[%s] deleting %s on %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+// handleMessageDeleteFile deletes a replica this node holds for the peer
+// that owns it, objects of this node and replicas of other owners are left
+// alone
+func (fs *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	if err := fs.checkOwner(from, msg.Key); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] deleting %s as asked by %s", fs.Transport.Addr(), msg.Key, from)
+
+	if err := fs.store.Delete(msg.Key); err != nil {
+		return err
+	}
+	fs.readvertise()
+	return fs.cache.remove(msg.Key)
+}
+
+// checkOwner returns an error unless key is a replica this node holds for
+// the peer connected from from
+func (fs *FileServer) checkOwner(from, key string) error {
+	meta, err := fs.store.Stat(key)
+	if err != nil {
+		return err
+	}
+	owner := fs.peerAddr(from)
+	if !isWireKey(key) || meta.Owner == fs.Transport.Addr() || owner == "" || meta.Owner != owner {
+		return fmt.Errorf("[%s] %s is owned by %q, not by %s", fs.Transport.Addr(), key, meta.Owner, from)
+	}
+	return nil
+}
+
+func (fs *FileServer) reapLoop() {
+	interval := fs.ReapInterval
+	if interval <= 0 {
+		interval = defaultReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.Reap()
+		case <-fs.quitch:
+			return
+		}
+	}
+}
+
+// Reap deletes every expired object and returns how many were deleted.
+// Objects this node owns are deleted cluster-wide through Delete, replicas
+// and cached copies expire on their own so they go away even while their
+// owner is down.
+func (fs *FileServer) Reap() int {
+	var (
+		now     = time.Now()
+		reaped  int
+		address = fs.Transport.Addr()
+	)
+
+	for _, meta := range fs.store.Expired(now) {
+		var err error
+		if meta.Owner == address {
+			err = fs.Delete(meta.Key)
+		} else {
+			err = fs.store.Delete(meta.Key)
+			fs.readvertise()
+		}
+		if err != nil {
+			log.Printf("[%s] reaping %s: %s", address, meta.Key, err)
+			continue
+		}
+		reaped++
+	}
+
+	for _, meta := range fs.cache.store.Expired(now) {
+		if err := fs.cache.remove(meta.Key); err != nil {
+			log.Printf("[%s] reaping cached %s: %s", address, meta.Key, err)
+			continue
+		}
+		reaped++
+	}
+
+	if reaped > 0 {
+		log.Printf("[%s] reaped %d expired objects", address, reaped)
+	}
+	return reaped
+}
@@ -1,3 +1,3 @@
 module dfs
 
-go 1.23.5
+go 1.24.0
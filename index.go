@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexDir is the folder inside the storage root holding the index log
+const indexDir = ".index"
+
+// compactMinGarbage is how many stale records the index log has to hold
+// before it is compacted. The log is never compacted while it holds fewer
+// stale than live records either.
+const compactMinGarbage = 1024
+
+// maxIndexRecord guards replay against a garbage length in a torn record
+const maxIndexRecord = 16 << 20
+
+const (
+	indexOpPut = iota + 1
+	indexOpDelete
+	// indexOpPending is appended before an object is written to the
+	// backend, an object whose put never got recorded after it is an
+	// orphan left by a crash
+	indexOpPending
+)
+
+// indexRecord is a single entry of the index log
+type indexRecord struct {
+	Op int
+	// Path is what the object is called in the backend of the store
+	Path string
+	// Size is the number of bytes the backend holds for the object
+	Size int64
+	// Tier is the tier of the store holding the object
+	Tier int
+	// Sealed is set when the object is encrypted at rest, KeyID is the key
+	// of the keyring it is encrypted with
+	Sealed bool
+	KeyID  uint32
+	// ReplicaKey is the key the replicas this node pushed of the object are
+	// encrypted with, 0 when that is not known
+	ReplicaKey uint32
+	// Replicas holds what this node knows about the replicas of an object
+	// it owns by the name of the peer holding them, see peerName
+	Replicas map[string]replica
+	// Accessed is when this node wrote the object, for objects in the cache
+	// also when it last served it
+	Accessed time.Time
+	// Blob is set for a replica stored once for every replica with the same
+	// content, it is the key of the object holding the bytes, see putShared
+	Blob string
+	Meta Metadata
+}
+
+// index is the embedded database of a Store. Every change is appended to a
+// log inside the storage root as a length and crc32 prefixed record and
+// replayed on start, a torn record at the end of the log left by a crash
+// is cut off. Once enough records are stale the log is compacted into a
+// fresh one holding only the live entries. In memory the keys are kept in
+// order for O(log n) lookups and prefix listings.
+type index struct {
+	mu         sync.RWMutex
+	dir        string
+	durability Durability
+	log        *os.File
+	keys       []string
+	entries    map[string]*indexRecord
+	// pending holds the backend path of every key with a put in flight
+	pending map[string]string
+	// refs counts the entries sharing every blob
+	refs map[string]int
+	// garbage counts the records in the log that no longer matter
+	garbage int
+	// bytes is the sum of the sizes of the entries
+	bytes int64
+}
+
+func (idx *index) logPath() string {
+	return idx.dir + string(os.PathSeparator) + "log"
+}
+
+// encodeIndexRecord frames rec the way it is stored in the log
+func encodeIndexRecord(rec *indexRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...), nil
+}
+
+func newIndex(dir string, durability Durability) *index {
+	return &index{
+		dir:        dir,
+		durability: durability,
+		entries:    make(map[string]*indexRecord),
+		pending:    make(map[string]string),
+		refs:       make(map[string]int),
+	}
+}
+
+// replay opens the log and applies every record in it
+func (idx *index) replay() error {
+	if err := os.MkdirAll(idx.dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(idx.logPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		hdr    = make([]byte, 8)
+		offset int64
+	)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		size := binary.LittleEndian.Uint32(hdr[:4])
+		if size > maxIndexRecord {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:]) {
+			break
+		}
+		rec := &indexRecord{}
+		if err := json.Unmarshal(payload, rec); err != nil {
+			break
+		}
+
+		idx.apply(rec)
+		offset += int64(len(hdr)) + int64(size)
+	}
+
+	//whatever follows the last good record was torn by a crash
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	idx.log = f
+	return nil
+}
+
+// apply updates the in memory state with rec, it has to be called with
+// the lock held
+func (idx *index) apply(rec *indexRecord) {
+	key := rec.Meta.Key
+	if rec.Op == indexOpPending {
+		idx.pending[key] = rec.Path
+		//stale as soon as the put is recorded
+		idx.garbage++
+		return
+	}
+	delete(idx.pending, key)
+
+	old, exists := idx.entries[key]
+	if exists {
+		idx.bytes -= old.Size
+		if old.Blob != "" {
+			if idx.refs[old.Blob]--; idx.refs[old.Blob] == 0 {
+				delete(idx.refs, old.Blob)
+			}
+		}
+	}
+
+	switch rec.Op {
+	case indexOpPut:
+		idx.bytes += rec.Size
+		if rec.Blob != "" {
+			idx.refs[rec.Blob]++
+		}
+		if exists {
+			idx.garbage++
+		} else {
+			i := sort.SearchStrings(idx.keys, key)
+			idx.keys = append(idx.keys, "")
+			copy(idx.keys[i+1:], idx.keys[i:])
+			idx.keys[i] = key
+		}
+		idx.entries[key] = rec
+	case indexOpDelete:
+		idx.garbage++
+		if exists {
+			idx.garbage++
+			delete(idx.entries, key)
+			i := sort.SearchStrings(idx.keys, key)
+			idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+		}
+	}
+}
+
+// append writes rec to the log and applies it, it has to be called with
+// the lock held
+func (idx *index) append(rec *indexRecord) error {
+	if idx.log == nil {
+		if err := idx.replay(); err != nil {
+			return err
+		}
+	}
+
+	buf, err := encodeIndexRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.log.Write(buf); err != nil {
+		return err
+	}
+	if idx.durability != DurabilityNone {
+		if err := idx.log.Sync(); err != nil {
+			return err
+		}
+	}
+
+	idx.apply(rec)
+
+	if idx.garbage >= compactMinGarbage && idx.garbage > len(idx.entries) {
+		if err := idx.compact(); err != nil {
+			log.Printf("compacting the index in %s: %s", idx.dir, err)
+		}
+	}
+	return nil
+}
+
+// begin records that the object for key is about to be written to path in
+// the backend
+func (idx *index) begin(key, path string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.append(&indexRecord{Op: indexOpPending, Path: path, Meta: Metadata{Key: key}})
+}
+
+// claim moves the entry of an object found in the backend when the index
+// was built, recorded under legacy, to key unless key has an entry or a
+// put in flight. It reports whether key has an entry afterwards.
+func (idx *index) claim(key, legacy string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.entries[key]; ok {
+		return true
+	}
+	old, ok := idx.entries[legacy]
+	if !ok {
+		return false
+	}
+	if _, ok := idx.pending[key]; ok {
+		return false
+	}
+	rec := *old
+	rec.Op = indexOpPut
+	rec.Meta.Key = key
+	if err := idx.append(&rec); err != nil {
+		return false
+	}
+	return idx.append(&indexRecord{Op: indexOpDelete, Meta: Metadata{Key: legacy}}) == nil
+}
+
+func (idx *index) put(rec *indexRecord) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	rec.Op = indexOpPut
+	return idx.append(rec)
+}
+
+// update applies fn to a copy of the entry of key and records the result,
+// unless fn returns false
+func (idx *index) update(key string, fn func(rec *indexRecord) bool) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	rec, ok := idx.entries[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	updated := *rec
+	if !fn(&updated) {
+		return nil
+	}
+	return idx.append(&updated)
+}
+
+func (idx *index) remove(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.entries[key]; !ok {
+		return nil
+	}
+	return idx.append(&indexRecord{Op: indexOpDelete, Meta: Metadata{Key: key}})
+}
+
+// get returns a copy of the metadata of key
+func (idx *index) get(key string) (*Metadata, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	rec, ok := idx.entries[key]
+	if !ok {
+		return nil, false
+	}
+	meta := rec.Meta
+	return &meta, true
+}
+
+// all returns a copy of the metadata of every entry in key order
+func (idx *index) all() []*Metadata {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	metas := make([]*Metadata, 0, len(idx.keys))
+	for _, key := range idx.keys {
+		meta := idx.entries[key].Meta
+		metas = append(metas, &meta)
+	}
+	return metas
+}
+
+// touch records that the object for key was just served
+func (idx *index) touch(key string) error {
+	return idx.update(key, func(rec *indexRecord) bool {
+		rec.Accessed = time.Now()
+		return true
+	})
+}
+
+// tier returns the tier holding key
+func (idx *index) tier(key string) (int, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	rec, ok := idx.entries[key]
+	if !ok {
+		return 0, false
+	}
+	return rec.Tier, true
+}
+
+// setTier records that key moved to tier
+func (idx *index) setTier(key string, tier int) error {
+	return idx.update(key, func(rec *indexRecord) bool {
+		rec.Tier = tier
+		return true
+	})
+}
+
+// sealed reports whether the object for key is encrypted at rest
+func (idx *index) sealed(key string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	rec, ok := idx.entries[key]
+	return ok && rec.Sealed
+}
+
+// records returns a copy of every entry in key order
+func (idx *index) records() []indexRecord {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	recs := make([]indexRecord, 0, len(idx.keys))
+	for _, key := range idx.keys {
+		recs = append(recs, *idx.entries[key])
+	}
+	return recs
+}
+
+// blob returns the blob the entry of key shares, empty when it has its own
+// bytes
+func (idx *index) blob(key string) string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if rec, ok := idx.entries[key]; ok {
+		return rec.Blob
+	}
+	return ""
+}
+
+// aliases returns the keys of the entries sharing blob
+func (idx *index) aliases(blob string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var keys []string
+	for key, rec := range idx.entries {
+		if rec.Blob == blob {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// shared returns the number of entries sharing blob
+func (idx *index) shared(blob string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.refs[blob]
+}
+
+// stored returns the number of bytes held for key
+func (idx *index) stored(key string) (int64, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	rec, ok := idx.entries[key]
+	if !ok {
+		return 0, false
+	}
+	return rec.Size, true
+}
+
+// usage returns the number of bytes held for all entries and their count
+func (idx *index) usage() (int64, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.bytes, len(idx.entries)
+}
+
+func (idx *index) has(key string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	_, ok := idx.entries[key]
+	return ok
+}
+
+// page returns at most limit keys starting with prefix that sort after
+// cursor, together with the cursor of the next page
+func (idx *index) page(prefix, cursor string, limit int) ([]string, string) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	start := prefix
+	if cursor > start {
+		start = cursor
+	}
+	i := sort.SearchStrings(idx.keys, start)
+	if i < len(idx.keys) && idx.keys[i] == cursor {
+		i++
+	}
+
+	keys := []string{}
+	for ; i < len(idx.keys) && strings.HasPrefix(idx.keys[i], prefix); i++ {
+		if limit > 0 && len(keys) == limit {
+			return keys, keys[len(keys)-1]
+		}
+		keys = append(keys, idx.keys[i])
+	}
+	return keys, ""
+}
+
+// compact rewrites the log with only the live entries and swaps it in, it
+// has to be called with the lock held
+func (idx *index) compact() error {
+	if idx.log == nil {
+		return nil
+	}
+
+	tmp := idx.logPath() + ".compact"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, key := range idx.keys {
+		buf, err := encodeIndexRecord(idx.entries[key])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(buf)
+	}
+	for key, path := range idx.pending {
+		buf, err := encodeIndexRecord(&indexRecord{Op: indexOpPending, Path: path, Meta: Metadata{Key: key}})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(buf)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, idx.logPath()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(idx.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	idx.log.Close()
+	idx.log = f
+	idx.garbage = 0
+	return nil
+}
+
+// reset forgets every entry and closes the log, the log is opened again
+// on the next change
+func (idx *index) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.log != nil {
+		idx.log.Close()
+		idx.log = nil
+	}
+	idx.keys = nil
+	idx.entries = make(map[string]*indexRecord)
+	idx.pending = make(map[string]string)
+	idx.refs = make(map[string]int)
+	idx.garbage = 0
+	idx.bytes = 0
+}
+
+// legacyPrefix starts the key an object is recorded under when the index
+// is built from the objects of a store that had none. Only the name of
+// such an object is known, it is recorded under its key once it is
+// looked up by it, see claim.
+const legacyPrefix = "legacy:"
+
+// isLegacyKey reports whether key is the key of an object that has not
+// been looked up by its key since the index was built
+func isLegacyKey(key string) bool {
+	return strings.HasPrefix(key, legacyPrefix)
+}
+
+// openIndex opens the index of the store. A store without an index log yet
+// gets one recording every object its backend holds. Objects a crash left
+// in the backend without a record are removed.
+func (s *Store) openIndex() error {
+	idx := s.index
+	_, statErr := os.Stat(idx.logPath())
+
+	idx.mu.Lock()
+	err := idx.replay()
+	if err == nil {
+		err = s.removeOrphans()
+	}
+	idx.mu.Unlock()
+	if err == nil {
+		err = s.removeUnsharedBlobs()
+	}
+	if err != nil {
+		return err
+	}
+	if !errors.Is(statErr, os.ErrNotExist) {
+		return nil
+	}
+
+	names, err := s.Backend.List("")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		size, err := s.Backend.Stat(name)
+		if err != nil {
+			return err
+		}
+		//such an object has no checksum to verify
+		rec := &indexRecord{Path: name, Size: size, Meta: Metadata{Key: legacyPrefix + name, Size: size, Version: 1}}
+		if err := idx.put(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim records the object found for key when the index was built under
+// key, it reports whether the index knows key
+func (s *Store) claim(key string) bool {
+	return s.index.claim(key, legacyPrefix+s.name(key))
+}
+
+// removeOrphans deletes what the puts that never got recorded wrote to the
+// backend and drops their pending records, it has to be called with the
+// index lock held. An object whose key still has a record is left alone,
+// the scrubber catches it if the put got as far as replacing it.
+func (s *Store) removeOrphans() error {
+	idx := s.index
+	if len(idx.pending) == 0 {
+		return nil
+	}
+	for key, path := range idx.pending {
+		if _, ok := idx.entries[key]; ok {
+			continue
+		}
+		if err := s.Backend.Delete(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		log.Printf("removed orphaned object %s", key)
+	}
+	idx.pending = make(map[string]string)
+	return idx.compact()
+}
+
+// CompactIndex compacts the index log right away
+func (s *Store) CompactIndex() error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+
+	return s.index.compact()
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"dfs/seal"
+)
+
+// keyringDir is the folder inside the storage root holding the keyring
+const keyringDir = ".keyring"
+
+// keyringIterations is the number of pbkdf2 rounds turning a passphrase
+// into a master key
+const keyringIterations = 600_000
+
+// the master key can be handed to a node through the environment, as 32
+// hex encoded bytes or as a passphrase
+const (
+	envMasterKey  = "DFS_MASTER_KEY"
+	envPassphrase = "DFS_PASSPHRASE"
+	// envClusterSecret holds the hex encoded cluster secret
+	envClusterSecret = "DFS_CLUSTER_SECRET"
+)
+
+var (
+	// ErrNoMasterKey is returned when opening a keyring without any way
+	// to get at its master key
+	ErrNoMasterKey = errors.New("no master key, set " + envMasterKey + " or " + envPassphrase)
+	// ErrWrongMasterKey is returned when the master key does not open the
+	// keyring
+	ErrWrongMasterKey = errors.New("the master key does not open the keyring")
+	// ErrUnknownKey is returned when data was encrypted with a key the
+	// keyring does not hold
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrNoClusterSecret is returned when convergent encryption is used
+	// with a keyring that has no cluster secret
+	ErrNoClusterSecret = errors.New("no cluster secret, set " + envClusterSecret)
+)
+
+type KeyringOpts struct {
+	// Path is the file holding the keyring, defaults to a file in the
+	// storage root
+	Path string
+	// MasterKey is the 32 byte key sealing the keyring. When neither it nor
+	// Passphrase is set they are taken from the environment.
+	MasterKey []byte
+	// Passphrase is turned into the master key with pbkdf2
+	Passphrase string
+	// ClusterSecret is shared by every node of the cluster and keys the
+	// convergent encryption, it is stored in the keyring once given. When
+	// not set it is taken from the environment.
+	ClusterSecret []byte
+}
+
+// keyringFile is the keyring as it is stored, the keys are sealed with
+// AES-GCM under the master key
+type keyringFile struct {
+	// Salt and Iterations derive the master key from a passphrase
+	Salt       []byte
+	Iterations int
+	Nonce      []byte
+	Sealed     []byte
+}
+
+type keyringKeys struct {
+	Current uint32
+	// Latest is the highest id ever handed out, ids of retired keys are
+	// not reused
+	Latest  uint32
+	Keys    map[uint32][]byte
+	Cluster []byte
+	Names   []byte
+	Signing []byte
+}
+
+// Keyring holds every key this node ever encrypted data with, so data keeps
+// decrypting across restarts. Every key has an id that is recorded in the
+// header of the data it encrypted, new data is encrypted with the current
+// key.
+type Keyring struct {
+	mu      sync.RWMutex
+	path    string
+	master  []byte
+	salt    []byte
+	current uint32
+	latest  uint32
+	keys    map[uint32][]byte
+	// cluster is the cluster secret
+	cluster []byte
+	// names is the client secret keys are hashed with before they are
+	// handed to peers
+	names []byte
+	// signing is the private key objects written by this node are signed
+	// with
+	signing ed25519.PrivateKey
+}
+
+// newKeyring returns a keyring holding a single fresh key that only lives
+// in memory
+func newKeyring() *Keyring {
+	return &Keyring{
+		current: 1,
+		latest:  1,
+		keys:    map[uint32][]byte{1: newEncryptionKey()},
+		names:   newEncryptionKey(),
+		signing: newSigningKey(),
+	}
+}
+
+// OpenKeyring loads the keyring at opts.Path, a keyring that does not
+// exist yet is created with a fresh key
+func OpenKeyring(opts KeyringOpts) (*Keyring, error) {
+	b, err := os.ReadFile(opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKeyring(opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("reading keyring %s: %w", opts.Path, err)
+	}
+	master, err := masterKey(opts, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := seal.NewAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Sealed, []byte(keyringDir))
+	if err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	var keys keyringKeys
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return nil, fmt.Errorf("reading keyring %s: %w", opts.Path, err)
+	}
+	if _, ok := keys.Keys[keys.Current]; !ok {
+		return nil, fmt.Errorf("keyring %s misses its current key", opts.Path)
+	}
+
+	for id := range keys.Keys {
+		keys.Latest = max(keys.Latest, id)
+	}
+	k := &Keyring{
+		path:    opts.Path,
+		master:  master,
+		salt:    file.Salt,
+		current: keys.Current,
+		latest:  keys.Latest,
+		keys:    keys.Keys,
+		cluster: keys.Cluster,
+		names:   keys.Names,
+		signing: keys.Signing,
+	}
+	if k.names == nil || k.signing == nil {
+		// keyrings written before keys were hashed or objects were signed
+		// get their secrets now
+		if k.names == nil {
+			k.names = newEncryptionKey()
+		}
+		if k.signing == nil {
+			k.signing = newSigningKey()
+		}
+		if err := k.save(); err != nil {
+			return nil, err
+		}
+	}
+	return k, k.setCluster(opts)
+}
+
+func createKeyring(opts KeyringOpts) (*Keyring, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	master, err := masterKey(opts, salt, keyringIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	k := newKeyring()
+	k.path = opts.Path
+	k.master = master
+	k.salt = salt
+	if err := k.setCluster(opts); err != nil {
+		return nil, err
+	}
+	if err := k.save(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// setCluster takes the cluster secret of opts or the environment and
+// saves it when it differs from the one in the keyring
+func (k *Keyring) setCluster(opts KeyringOpts) error {
+	secret := opts.ClusterSecret
+	if secret == nil {
+		if env := os.Getenv(envClusterSecret); env != "" {
+			var err error
+			if secret, err = hex.DecodeString(env); err != nil {
+				return fmt.Errorf("%s: %w", envClusterSecret, err)
+			}
+		}
+	}
+	if secret == nil || hmac.Equal(secret, k.cluster) {
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.cluster = secret
+	return k.save()
+}
+
+// masterKey returns the master key of opts, a passphrase is stretched with
+// salt
+func masterKey(opts KeyringOpts, salt []byte, iterations int) ([]byte, error) {
+	if opts.MasterKey == nil && opts.Passphrase == "" {
+		if env := os.Getenv(envMasterKey); env != "" {
+			key, err := hex.DecodeString(env)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", envMasterKey, err)
+			}
+			opts.MasterKey = key
+		}
+		opts.Passphrase = os.Getenv(envPassphrase)
+	}
+
+	switch {
+	case opts.MasterKey != nil:
+		if len(opts.MasterKey) != 32 {
+			return nil, fmt.Errorf("master key has %d bytes, want 32", len(opts.MasterKey))
+		}
+		return opts.MasterKey, nil
+	case opts.Passphrase != "":
+		return pbkdf2.Key(sha256.New, opts.Passphrase, salt, iterations, 32)
+	}
+	return nil, ErrNoMasterKey
+}
+
+// save writes the keyring to its file, an in memory keyring is not saved.
+// It has to be called with the lock held.
+func (k *Keyring) save() error {
+	if k.path == "" {
+		return nil
+	}
+
+	plain, err := json.Marshal(keyringKeys{Current: k.current, Latest: k.latest, Keys: k.keys, Cluster: k.cluster, Names: k.names, Signing: k.signing})
+	if err != nil {
+		return err
+	}
+	aead, err := seal.NewAEAD(k.master)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	b, err := json.Marshal(keyringFile{
+		Salt:       k.salt,
+		Iterations: keyringIterations,
+		Nonce:      nonce,
+		Sealed:     aead.Seal(nil, nonce, plain, []byte(keyringDir)),
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(k.path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-keyring-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), k.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Current returns the id and the key new data is encrypted with
+func (k *Keyring) Current() (uint32, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current, k.keys[k.current]
+}
+
+// Key returns the key with the given id
+func (k *Keyring) Key(id uint32) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// clusterSecret returns the secret shared by the nodes of the cluster
+func (k *Keyring) clusterSecret() ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.cluster == nil {
+		return nil, ErrNoClusterSecret
+	}
+	return k.cluster, nil
+}
+
+// nameKey returns the client secret keys are hashed with
+func (k *Keyring) nameKey() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.names
+}
+
+// signingKey returns the private key objects are signed with
+func (k *Keyring) signingKey() ed25519.PrivateKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.signing
+}
+
+// IDs returns the ids of every key in the keyring in ascending order
+func (k *Keyring) IDs() []uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Rotate adds a fresh key and makes it the current one, the old keys are
+// kept to decrypt what they encrypted. It returns the id of the new key.
+func (k *Keyring) Rotate() (uint32, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id, prev := k.latest+1, k.current
+	k.keys[id] = newEncryptionKey()
+	k.current, k.latest = id, id
+	if err := k.save(); err != nil {
+		delete(k.keys, id)
+		k.current, k.latest = prev, id-1
+		return 0, err
+	}
+	return id, nil
+}
+
+// Retire removes the key with the given id, whatever it encrypted can't
+// be decrypted anymore. The current key can't be retired.
+func (k *Keyring) Retire(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	if id == k.current {
+		return errors.New("the current key can't be retired")
+	}
+	delete(k.keys, id)
+	if err := k.save(); err != nil {
+		k.keys[id] = key
+		return err
+	}
+	return nil
+}
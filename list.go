@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"dfs/p2p"
+)
+
+// listPageSize is the number of keys asked from a peer at a time
+const listPageSize = 1000
+
+// MessageListFiles asks a peer for at most Limit of its keys starting with
+// Prefix that sort after Cursor
+type MessageListFiles struct {
+	Prefix string
+	Cursor string
+	Limit  int
+}
+
+// listPage is the reply to MessageListFiles, Next is the cursor for the
+// following page and empty once there are no more keys. Sealed holds the
+// sealed metadata of every replica among Keys at the same index, so the
+// owner can tell what its replicas are called.
+type listPage struct {
+	Keys   []string
+	Sealed [][]byte
+	Next   string
+}
+
+// List returns at most limit keys starting with prefix in order, beginning
+// after cursor. The returned cursor continues the listing and is empty once
+// all keys have been returned. A limit of 0 returns every key.
+func (s *Store) List(prefix, cursor string, limit int) ([]string, string, error) {
+	keys, next := s.index.page(prefix, cursor, limit)
+	return keys, next, nil
+}
+
+// List returns every key starting with prefix stored anywhere in the
+// cluster, the listings of the local store and of every peer are merged
+// into one ordered list without duplicates. Replicas of objects of this
+// node are listed by the keys their metadata was sealed with, the hashed
+// keys of other replicas, the blobs they share and objects not looked up
+// since the index was built are left out.
+func (fs *FileServer) List(prefix string) ([]string, error) {
+	local, _, err := fs.store.List(prefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	replicas, _, err := fs.store.List(wireKeyPrefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(local))
+	add := func(key string) {
+		if listed(key) && strings.HasPrefix(key, prefix) {
+			seen[key] = struct{}{}
+		}
+	}
+	for _, key := range local {
+		add(key)
+	}
+	for _, key := range replicas {
+		if meta, err := fs.store.Stat(key); err == nil {
+			add(fs.replicaName(key, meta.Sealed))
+		}
+	}
+
+	for _, peer := range fs.peerList() {
+		keys, err := fs.listPeer(peer, prefix)
+		var names []string
+		if err == nil {
+			names, err = fs.listPeer(peer, wireKeyPrefix)
+		}
+		if err != nil {
+			log.Printf("[%s] listing %s on %s: %s", fs.Transport.Addr(), prefix, peer.RemoteAddr(), err)
+			continue
+		}
+		for _, key := range append(keys, names...) {
+			add(key)
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// listed reports whether key is one of the keys FileServer.List returns
+func listed(key string) bool {
+	return !isWireKey(key) && !isBlobKey(key) && !isLegacyKey(key)
+}
+
+// replicaName returns the key of the object of this node whose replica is
+// called wire, as read from the sealed metadata of the replica. It returns
+// wire when the metadata can't be opened by this node.
+func (fs *FileServer) replicaName(wire string, sealed []byte) string {
+	if sealed == nil {
+		return wire
+	}
+	meta, err := fs.openMeta(&Metadata{Key: wire, Sealed: sealed})
+	if err != nil || fs.wireKey(meta.Key) != wire {
+		return wire
+	}
+	return meta.Key
+}
+
+// listPeer pages through every key of peer starting with prefix, replicas
+// of objects of this node are returned by their keys
+func (fs *FileServer) listPeer(peer p2p.Peer, prefix string) ([]string, error) {
+	var (
+		keys   []string
+		cursor string
+	)
+	for {
+		page, err := fs.requestList(peer, prefix, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range page.Keys {
+			if i < len(page.Sealed) {
+				key = fs.replicaName(key, page.Sealed[i])
+			}
+			keys = append(keys, key)
+		}
+		if page.Next == "" {
+			return keys, nil
+		}
+		cursor = page.Next
+	}
+}
+
+func (fs *FileServer) requestList(peer p2p.Peer, prefix, cursor string) (*listPage, error) {
+	msg := Message{
+		Payload: MessageListFiles{
+			Prefix: prefix,
+			Cursor: cursor,
+			Limit:  listPageSize,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	page := &listPage{}
+	if _, err := readFrame(peer, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (fs *FileServer) handleMessageListFiles(from string, msg MessageListFiles) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	keys, next, err := fs.store.List(msg.Prefix, msg.Cursor, msg.Limit)
+	if err != nil {
+		fs.sendFailure(peer, err)
+		return err
+	}
+	page := &listPage{Keys: keys, Next: next}
+	for _, key := range keys {
+		var sealed []byte
+		if isWireKey(key) {
+			if meta, err := fs.store.Stat(key); err == nil {
+				sealed = meta.Sealed
+			}
+		}
+		page.Sealed = append(page.Sealed, sealed)
+	}
+	return fs.sendFrame(peer, page)
+}
@@ -17,6 +17,8 @@ func OnPeer(peer p2p.Peer) error {
 	return nil
 }
 
+// makeServer makes a server whose keyring is sealed with the master key or
+// passphrase from the environment
 func makeServer(listenAddr, root string, nodes ...string) *FileServer {
 
 	tcpOpts := &p2p.TCPTransportOpts{
@@ -28,19 +30,26 @@ func makeServer(listenAddr, root string, nodes ...string) *FileServer {
 	tcpTransport := p2p.NewTCPTransport(tcpOpts)
 
 	FileServerOpts := &FileServerOpts{
-		EncKey:            newEncryptionKey(),
 		storageRoot:       root + string(os.PathSeparator) + "network_" + listenAddr,
 		PathTransformFunc: CASPathTransformFunc,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
 	}
-	s := NewFileServer(FileServerOpts)
+	s, err := NewFileServer(FileServerOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 
 }
 func main() {
+	//the keyrings of the nodes are sealed with a key only the operator has
+	if os.Getenv(envMasterKey) == "" && os.Getenv(envPassphrase) == "" {
+		log.Fatal(ErrNoMasterKey)
+	}
 	s1 := makeServer(":3000", "./")
 	s2 := makeServer(":4000", "./", ":3000")
 	s3 := makeServer(":5000", "./", ":3000", ":4000")
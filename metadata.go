@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Metadata describes an object, it is kept in the index of the store and
+// replicated together with the object
+type Metadata struct {
+	// Key is the key the object was stored under
+	Key string
+	// Size is the size of the object as written by its owner
+	Size        int64
+	ContentType string
+	Created     time.Time
+	Modified    time.Time
+	// Owner is the address of the node that wrote the object
+	Owner string
+	Tags  map[string]string
+	// Checksum is the sha256 of the object as read from the store of this
+	// node, on a replica those are the bytes encrypted by the owner
+	Checksum []byte
+	// Version counts the writes of the object on this node
+	Version uint64
+	// Expires is when the object is deleted by the reaper, the zero time
+	// never expires
+	Expires time.Time
+	// Sealed is the metadata of a replica as its owner wrote it, encrypted
+	// with the keyring of the owner. The key of a replica is hashed and
+	// only the fields a peer needs to look after it are set.
+	Sealed []byte
+	// Signer and Signature sign the object when its writer signs objects,
+	// see signed for what the signature covers
+	Signer    ed25519.PublicKey
+	Signature []byte
+}
+
+// detectContentType fills in the content type from the first bytes of the
+// object when none was given
+func (m *Metadata) detectContentType(head []byte) {
+	if m.ContentType == "" {
+		m.ContentType = http.DetectContentType(head)
+	}
+}
+
+// Stat returns the metadata of the object for key
+func (s *Store) Stat(key string) (*Metadata, error) {
+	s.claim(key)
+	meta, ok := s.index.get(key)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return meta, nil
+}
+
+// Checksum returns the sha256 checksum recorded for the object of key
+func (s *Store) Checksum(key string) ([]byte, error) {
+	meta, ok := s.index.get(key)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return meta.Checksum, nil
+}
+
+// prepare fills in the fields of meta that are derived when the object is
+// written. Replicas keep the times set by the owner, a new object of the
+// owner carries over Created from the object it replaces
+func (s *Store) prepare(meta *Metadata, size int64, checksum, head []byte) {
+	now := time.Now()
+	old, _ := s.index.get(meta.Key)
+
+	if meta.Size == 0 {
+		meta.Size = size
+	}
+	meta.Checksum = checksum
+	if meta.Modified.IsZero() {
+		meta.Modified = now
+	}
+	if meta.Created.IsZero() {
+		meta.Created = now
+		if old != nil && !old.Created.IsZero() {
+			meta.Created = old.Created
+		}
+	}
+	meta.Version = 1
+	if old != nil {
+		meta.Version = old.Version + 1
+	}
+	meta.detectContentType(head)
+}
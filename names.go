@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Keys never leave a node as they are, peers only see them hashed with HMAC
+// under the client secret of the keyring. The metadata of an object, its
+// key included, is replicated sealed with the keyring, so a peer holding a
+// replica learns nothing but its size, owner and expiry.
+
+// wireKeyPrefix starts every hashed key, it tells replicas apart from the
+// objects a node owns
+const wireKeyPrefix = "hmac:"
+
+// wireKey returns what key is called on the peers
+func (fs *FileServer) wireKey(key string) string {
+	mac := hmac.New(sha256.New, fs.keys.nameKey())
+	mac.Write([]byte(key))
+	return wireKeyPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isWireKey reports whether key is the hashed key of a replica
+func isWireKey(key string) bool {
+	return strings.HasPrefix(key, wireKeyPrefix)
+}
+
+// remoteKey returns what the object described by meta is called on the
+// peers, a replica this node holds is already known by its hashed key
+func (fs *FileServer) remoteKey(meta *Metadata) string {
+	if isWireKey(meta.Key) {
+		return meta.Key
+	}
+	return fs.wireKey(meta.Key)
+}
+
+// sealMeta returns the metadata peers keep for meta: the hashed key and
+// what they need to look after the replica, with the whole of meta sealed
+// in Sealed
+func (fs *FileServer) sealMeta(meta Metadata) (Metadata, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return Metadata{}, err
+	}
+	sealed := new(bytes.Buffer)
+	if _, err := copyEncrypt(fs.keys, bytes.NewReader(b), sealed); err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		Key:     fs.wireKey(meta.Key),
+		Owner:   meta.Owner,
+		Expires: meta.Expires,
+		Sealed:  sealed.Bytes(),
+	}, nil
+}
+
+// openMeta returns the metadata sealed in the metadata of a replica,
+// metadata that was not sealed is returned as it is
+func (fs *FileServer) openMeta(meta *Metadata) (*Metadata, error) {
+	if meta.Sealed == nil {
+		return meta, nil
+	}
+	b := new(bytes.Buffer)
+	if _, err := copyDecrypt(fs.keys, bytes.NewReader(meta.Sealed), b); err != nil {
+		return nil, err
+	}
+	opened := &Metadata{}
+	if err := json.Unmarshal(b.Bytes(), opened); err != nil {
+		return nil, err
+	}
+	return opened, nil
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -22,24 +24,44 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 	peekBuf := make([]byte, 1)
 
 	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+		return err
 	}
 
 	//in case of stream we are not decoding what is being sent over the
 	//network we are just setting Stream true so wecan handle that
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch peekBuf[0] {
+	case IncomingStream:
 		rpc.Stream = true
 		return nil
+	case IncomingUpload:
+		rpc.Stream, rpc.Upload = true, true
+		return nil
 	}
 
-	buf := make([]byte, 1028)
+	//messages are prefixed with their length so a message never gets mixed
+	//up with whatever is sent right after it
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d", size, MaxMessageSize)
+	}
 
-	n, err := r.Read(buf)
-	if err != nil {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	rpc.Payload = buf[:n]
+	rpc.Payload = buf
 
 	return nil
 }
+
+// EncodeMessage frames payload the way DefaultDecoder expects it, the
+// IncomingMessage marker followed by the length of the payload
+func EncodeMessage(payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
+}
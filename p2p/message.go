@@ -2,13 +2,22 @@ package p2p
 
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	// IncomingStream starts the reply to a request
+	IncomingStream = 0x2
+	// IncomingUpload starts the data a message announced, it is told apart
+	// from a reply so both can be waited for at the same time
+	IncomingUpload = 0x3
 )
 
+// MaxMessageSize is the largest message payload DefaultDecoder accepts
+const MaxMessageSize = 4 << 20
+
 // RCP holds any arbitrary data that is begin sent over the
 // each transport between two nodes in the network
 type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	// Upload is set together with Stream for an IncomingUpload
+	Upload bool
 }
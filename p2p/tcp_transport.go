@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"sync"
+	"time"
 )
 
+// DefaultStreamTimeout is how long a stream waits to be picked up when
+// TCPTransportOpts leaves StreamTimeout unset
+const DefaultStreamTimeout = time.Minute
+
 // TCPPeer represents the remote node over a TCP established connection.
 type TCPPeer struct {
 	//the underlying connection of the peer
@@ -17,19 +21,67 @@ type TCPPeer struct {
 	// If we accept the incoming connection => outbound => false
 	outbound bool
 
-	wg *sync.WaitGroup
+	timeout time.Duration
+	// streamch and uploadch are signalled by the read loop once it has
+	// consumed an IncomingStream or IncomingUpload marker and stopped
+	// reading from the connection
+	streamch chan struct{}
+	uploadch chan struct{}
+	// donech is signalled by CloseStream
+	donech chan struct{}
+	// closech is closed when the read loop exits and the connection is dropped
+	closech chan struct{}
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		timeout:  DefaultStreamTimeout,
+		streamch: make(chan struct{}),
+		uploadch: make(chan struct{}),
+		donech:   make(chan struct{}, 1),
+		closech:  make(chan struct{}),
+	}
+}
+
+// WaitStream implements the Peer interface, it blocks until the read loop
+// has handed the connection over for a reply. From then on the caller
+// owns the reading side of the connection until it calls CloseStream
+func (p *TCPPeer) WaitStream() error {
+	return p.wait(p.streamch)
+}
+
+// WaitUpload implements the Peer interface, it is WaitStream for the data
+// of an upload
+func (p *TCPPeer) WaitUpload() error {
+	return p.wait(p.uploadch)
+}
+
+func (p *TCPPeer) wait(ch chan struct{}) error {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-p.closech:
+		return ErrPeerClosed
+	case <-timer.C:
+		//a stream coming in later would be read by whoever waits next
+		p.Conn.Close()
+		return ErrStreamTimeout
 	}
 }
 
+// Outbound implements the Peer interface, it reports whether the
+// connection was dialed by us
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	p.donech <- struct{}{}
 }
 
 // Send implements the Peer interface
@@ -43,6 +95,11 @@ type TCPTransportOpts struct {
 	HandShakeFunc HandShakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once the connection to a peer is dropped
+	OnPeerDisconnect func(Peer)
+	// StreamTimeout is how long a stream waits to be picked up, on the
+	// side waiting for it as well as on the side receiving it
+	StreamTimeout time.Duration
 }
 
 type TCPTransport struct {
@@ -121,12 +178,19 @@ func (t *TCPTransport) startAcceptLoop() {
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
+	peer := NewTCPPeer(conn, outbound)
+	if t.StreamTimeout > 0 {
+		peer.timeout = t.StreamTimeout
+	}
 	defer func() {
 		log.Printf("dropping peer connection : %s\n", err)
+		close(peer.closech)
 		conn.Close()
+		if t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
 
 	}()
-	peer := NewTCPPeer(conn, outbound)
 	if err = t.HandShakeFunc(peer); err != nil {
 		return
 	}
@@ -140,7 +204,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 
 	for {
 		rpc := &RPC{}
-		err := t.Decoder.Decode(conn, rpc)
+		err = t.Decoder.Decode(conn, rpc)
 
 		if err != nil {
 			fmt.Printf("TCP read error: %s\n", err)
@@ -150,9 +214,19 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		rpc.From = conn.RemoteAddr().String()
 
 		if rpc.Stream {
-			peer.wg.Add(1)
+			ch := peer.streamch
+			if rpc.Upload {
+				ch = peer.uploadch
+			}
+			select {
+			case ch <- struct{}{}:
+			case <-time.After(peer.timeout):
+				//nobody is waiting for the stream, what follows can't be read
+				err = ErrStreamTimeout
+				return
+			}
 			log.Printf("[%s] incoming [%s] waiting \n", t.Addr(), rpc.From)
-			peer.wg.Wait()
+			<-peer.donech
 			log.Printf("[%s] stream [%s] closed \n", t.Addr(), rpc.From)
 			continue
 		}
@@ -1,11 +1,25 @@
 package p2p
 
-import "net"
+import (
+	"errors"
+	"net"
+)
+
+// ErrPeerClosed is returned when waiting on a peer whose connection
+// has already been dropped
+var ErrPeerClosed = errors.New("peer connection closed")
+
+// ErrStreamTimeout is returned when a stream was not picked up in time on
+// either side, the connection is dropped as it is out of step
+var ErrStreamTimeout = errors.New("stream timed out")
 
 // Peer is an interface that represents the remote node
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	Outbound() bool
+	WaitStream() error
+	WaitUpload() error
 	CloseStream()
 }
 
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// packTombstone is the size of a record deleting an object
+	packTombstone = -1
+	// packPending is the size of a record still being written, it is
+	// replaced by the real size once all of the data is in the pack
+	packPending = -2
+)
+
+// packHeaderSize is the size of the name length and the object size in
+// front of every record
+const packHeaderSize = 4 + 8
+
+type packEntry struct {
+	offset int64
+	size   int64
+}
+
+// PackBackend keeps every object in a single file. Objects are appended to
+// the pack one after the other as a record holding the name, the size and
+// the data of the object, a deleted object is recorded by a tombstone. The
+// pack is scanned on open to find the latest record of every name, a
+// record left incomplete by a crash is cut off. Space taken by replaced
+// and deleted objects is not reclaimed, a SegmentBackend does that.
+type PackBackend struct {
+	path       string
+	durability Durability
+
+	// writeLock serializes appending to the pack
+	writeLock sync.Mutex
+	mu        sync.RWMutex
+	file      *os.File
+	entries   map[string]packEntry
+}
+
+// NewPackBackend opens the pack at path, creating it when it does not exist
+func NewPackBackend(path string, durability Durability) (*PackBackend, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &PackBackend{
+		path:       path,
+		durability: durability,
+		file:       f,
+		entries:    make(map[string]packEntry),
+	}
+	if err := b.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *PackBackend) scan() error {
+	end, err := scanRecords(b.file, func(name string, offset, size int64) {
+		if size == packTombstone {
+			delete(b.entries, name)
+			return
+		}
+		b.entries[name] = packEntry{offset: offset, size: size}
+	})
+	if err != nil {
+		return err
+	}
+
+	//whatever follows the last complete record was torn by a crash
+	return b.file.Truncate(end)
+}
+
+// scanRecords calls fn for every complete record of the pack or segment f
+// with the offset and size of its data, a tombstone has a size of
+// packTombstone. It returns the offset following the last complete record.
+func scanRecords(f *os.File, fn func(name string, offset, size int64)) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		hdr    = make([]byte, packHeaderSize)
+		offset int64
+	)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		nameLen := int64(binary.LittleEndian.Uint32(hdr[:4]))
+		size := int64(binary.LittleEndian.Uint64(hdr[4:]))
+		if size < packTombstone {
+			break
+		}
+
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			break
+		}
+		dataOffset := offset + packHeaderSize + nameLen
+		if size == packTombstone {
+			fn(string(name), dataOffset, size)
+			offset = dataOffset
+			continue
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			break
+		}
+		fn(string(name), dataOffset, size)
+		offset = dataOffset + size
+	}
+	return offset, nil
+}
+
+func (b *PackBackend) lookup(name string) (packEntry, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.entries[name]
+	if !ok {
+		return e, fmt.Errorf("object %s: %w", name, os.ErrNotExist)
+	}
+	return e, nil
+}
+
+func (b *PackBackend) end() (int64, error) {
+	fi, err := b.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func packHeader(name string, size int64) []byte {
+	hdr := make([]byte, packHeaderSize, packHeaderSize+len(name))
+	binary.LittleEndian.PutUint32(hdr[:4], uint32(len(name)))
+	binary.LittleEndian.PutUint64(hdr[4:], uint64(size))
+	return append(hdr, name...)
+}
+
+func (b *PackBackend) Put(name string, r io.Reader) (int64, error) {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	start, err := b.end()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := appendRecord(b.file, start, name, r, b.durability)
+	if err != nil {
+		//leave no trace of the failed record
+		b.file.Truncate(start)
+		return 0, err
+	}
+
+	b.mu.Lock()
+	b.entries[name] = packEntry{offset: start + packHeaderSize + int64(len(name)), size: n}
+	b.mu.Unlock()
+
+	return n, nil
+}
+
+// appendRecord writes a pending record for name at start of f and fills
+// in its size once all of r has been written
+func appendRecord(f *os.File, start int64, name string, r io.Reader, durability Durability) (int64, error) {
+	hdr := packHeader(name, packPending)
+	if _, err := f.WriteAt(hdr, start); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, start+int64(len(hdr))), r)
+	if err != nil {
+		return 0, err
+	}
+	if err := syncFile(f, durability); err != nil {
+		return 0, err
+	}
+
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(n))
+	if _, err := f.WriteAt(size, start+4); err != nil {
+		return 0, err
+	}
+	return n, syncFile(f, durability)
+}
+
+// appendTombstone records the deletion of name at start of f and returns
+// the size of the record
+func appendTombstone(f *os.File, start int64, name string, durability Durability) (int64, error) {
+	hdr := packHeader(name, packTombstone)
+	if _, err := f.WriteAt(hdr, start); err != nil {
+		return 0, err
+	}
+	return int64(len(hdr)), syncFile(f, durability)
+}
+
+func syncFile(f *os.File, durability Durability) error {
+	if durability == DurabilityNone {
+		return nil
+	}
+	return f.Sync()
+}
+
+func (b *PackBackend) Get(name string) (int64, io.ReadCloser, error) {
+	e, err := b.lookup(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return e.size, &sectionReadCloser{
+		SectionReader: io.NewSectionReader(b.file, e.offset, e.size),
+		Closer:        io.NopCloser(nil),
+	}, nil
+}
+
+func (b *PackBackend) Delete(name string) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	if _, err := b.lookup(name); err != nil {
+		return nil
+	}
+
+	start, err := b.end()
+	if err != nil {
+		return err
+	}
+	if _, err := appendTombstone(b.file, start, name, b.durability); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	delete(b.entries, name)
+	b.mu.Unlock()
+
+	return nil
+}
+
+func (b *PackBackend) Stat(name string) (int64, error) {
+	e, err := b.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+func (b *PackBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var names []string
+	for name := range b.entries {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *PackBackend) ReadAt(name string, p []byte, offset int64) (int, error) {
+	e, err := b.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return io.NewSectionReader(b.file, e.offset, e.size).ReadAt(p, offset)
+}
+
+// Close closes the pack file
+func (b *PackBackend) Close() error {
+	return b.file.Close()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"dfs/p2p"
+)
+
+// nearlyFull is the share of its byte or object limit at which a node is
+// no longer picked to hold replicas
+const nearlyFull = 0.95
+
+// Capacity is how much a node stores and how much it is allowed to store,
+// a limit of 0 is unlimited
+type Capacity struct {
+	Bytes      int64
+	Objects    int
+	MaxBytes   int64
+	MaxObjects int
+}
+
+// fits reports whether an object of size bytes can be added
+func (c Capacity) fits(size int64) bool {
+	if c.MaxObjects > 0 && c.Objects >= c.MaxObjects {
+		return false
+	}
+	return c.MaxBytes <= 0 || c.Bytes+size <= c.MaxBytes
+}
+
+func (c Capacity) nearlyFull() bool {
+	if c.MaxObjects > 0 && float64(c.Objects) >= nearlyFull*float64(c.MaxObjects) {
+		return true
+	}
+	return c.MaxBytes > 0 && float64(c.Bytes) >= nearlyFull*float64(c.MaxBytes)
+}
+
+// drifted reports whether c moved far enough from the capacity advertised
+// as old for peers to place replicas differently, by crossing into or out
+// of being nearly full or by a twentieth of a limit
+func (c Capacity) drifted(old Capacity) bool {
+	if c.nearlyFull() != old.nearlyFull() {
+		return true
+	}
+	if c.MaxBytes > 0 && abs(c.Bytes-old.Bytes) >= max(c.MaxBytes/20, 1) {
+		return true
+	}
+	return c.MaxObjects > 0 && abs(int64(c.Objects-old.Objects)) >= int64(max(c.MaxObjects/20, 1))
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// QuotaError is returned when storing an object would take a node past
+// its capacity
+type QuotaError struct {
+	Key      string
+	Size     int64
+	Capacity Capacity
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("storing %d bytes for %s exceeds the capacity of the node: %d of %d bytes and %d of %d objects used",
+		e.Size, e.Key, e.Capacity.Bytes, e.Capacity.MaxBytes, e.Capacity.Objects, e.Capacity.MaxObjects)
+}
+
+// MessageCapacity advertises the capacity of the sender
+type MessageCapacity struct {
+	Capacity Capacity
+}
+
+// Capacity returns how much the store holds and its limits
+func (s *Store) Capacity() Capacity {
+	bytes, objects := s.index.usage()
+	return Capacity{
+		Bytes:      bytes,
+		Objects:    objects,
+		MaxBytes:   s.MaxBytes,
+		MaxObjects: s.MaxObjects,
+	}
+}
+
+// capacity is Capacity with the writes in flight added, it has to be
+// called with quotaLock held
+func (s *Store) capacity() Capacity {
+	c := s.Capacity()
+	c.Bytes += s.reservedBytes
+	c.Objects += s.reservedObjects
+	return c
+}
+
+// CheckQuota returns a *QuotaError when storing size bytes for key would
+// take the store past its limits, the bytes of an object being replaced
+// are taken into account
+func (s *Store) CheckQuota(key string, size int64) error {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	c := s.capacity()
+	if old, ok := s.index.stored(key); ok {
+		c.Bytes -= old
+		c.Objects--
+	}
+	if !c.fits(size) {
+		return &QuotaError{Key: key, Size: size, Capacity: c}
+	}
+	return nil
+}
+
+// reservation accounts for the bytes of a write in flight so concurrent
+// writes can't overrun the limits together. Bytes up to the size of the
+// object being replaced are free.
+type reservation struct {
+	s      *Store
+	key    string
+	r      io.Reader
+	credit int64
+	read   int64
+	bytes  int64
+	object bool
+}
+
+// reserve makes room for a write of key reading from r, the write fails
+// with a *QuotaError as soon as it no longer fits
+func (s *Store) reserve(key string, r io.Reader) (*reservation, error) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	res := &reservation{s: s, key: key, r: r}
+	if old, ok := s.index.stored(key); ok {
+		res.credit = old
+		return res, nil
+	}
+
+	if c := s.capacity(); s.MaxObjects > 0 && c.Objects >= s.MaxObjects {
+		return nil, &QuotaError{Key: key, Capacity: c}
+	}
+	res.object = true
+	s.reservedObjects++
+	return res, nil
+}
+
+func (res *reservation) Read(p []byte) (int, error) {
+	n, err := res.r.Read(p)
+	res.read += int64(n)
+
+	if need := res.read - res.credit; need > res.bytes {
+		s := res.s
+		s.quotaLock.Lock()
+		c := s.capacity()
+		if s.MaxBytes > 0 && c.Bytes+need-res.bytes > s.MaxBytes {
+			s.quotaLock.Unlock()
+			return n, &QuotaError{Key: res.key, Size: res.read, Capacity: c}
+		}
+		s.reservedBytes += need - res.bytes
+		res.bytes = need
+		s.quotaLock.Unlock()
+	}
+	return n, err
+}
+
+// release gives back what was reserved, once the write is in the index
+// its bytes are accounted for there
+func (res *reservation) release() {
+	res.s.quotaLock.Lock()
+	defer res.s.quotaLock.Unlock()
+
+	res.s.reservedBytes -= res.bytes
+	if res.object {
+		res.s.reservedObjects--
+	}
+}
+
+// advertise tells peer the capacity of this node
+func (fs *FileServer) advertise(peer p2p.Peer) error {
+	c := fs.store.Capacity()
+
+	fs.capacityLock.Lock()
+	fs.advertised = c
+	fs.capacityLock.Unlock()
+
+	msg := Message{
+		Payload: MessageCapacity{Capacity: c},
+	}
+	return fs.send(peer, &msg)
+}
+
+// readvertise tells every peer the capacity of this node once it drifted
+// from what was advertised last, it is called after writes and deletes
+func (fs *FileServer) readvertise() {
+	c := fs.store.Capacity()
+
+	fs.capacityLock.Lock()
+	if !c.drifted(fs.advertised) {
+		fs.capacityLock.Unlock()
+		return
+	}
+	fs.advertised = c
+	fs.capacityLock.Unlock()
+
+	msg := Message{
+		Payload: MessageCapacity{Capacity: c},
+	}
+	for _, peer := range fs.peerList() {
+		if err := fs.send(peer, &msg); err != nil {
+			log.Printf("[%s] advertising capacity to %s: %s", fs.Transport.Addr(), peer.RemoteAddr(), err)
+		}
+	}
+}
+
+func (fs *FileServer) handleMessageCapacity(from string, msg MessageCapacity) error {
+	fs.capacityLock.Lock()
+	defer fs.capacityLock.Unlock()
+
+	fs.capacities[from] = msg.Capacity
+	return nil
+}
+
+// placement returns the peers that should hold a replica of size bytes,
+// peers that advertised being nearly full or too full for it are skipped
+func (fs *FileServer) placement(size int64) []p2p.Peer {
+	fs.capacityLock.Lock()
+	defer fs.capacityLock.Unlock()
+
+	var peers []p2p.Peer
+	for _, peer := range fs.peerList() {
+		c, ok := fs.capacities[peer.RemoteAddr().String()]
+		if ok && (c.nearlyFull() || !c.fits(size)) {
+			log.Printf("[%s] skipping %s which is nearly full", fs.Transport.Addr(), peer.RemoteAddr())
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
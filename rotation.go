@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"dfs/p2p"
+)
+
+// defaultRekeyInterval is how often objects still depending on an old key
+// are looked for while the keyring holds more than one key
+const defaultRekeyInterval = time.Minute
+
+// KeyStatus reports which keys of the keyring are still needed. A replica
+// keeps the key it was pushed with in use until the peer holding it is
+// back to receive it under the current key.
+type KeyStatus struct {
+	// Current is the key new data is encrypted with
+	Current uint32
+	// Pending counts per key the objects that still depend on it, owned
+	// objects whose replicas were pushed with an unknown key are counted
+	// under 0
+	Pending map[uint32]int
+	// Retirable are the old keys nothing depends on anymore
+	Retirable []uint32
+}
+
+// replica is what the owner of an object knows about the replica a peer
+// holds of it
+type replica struct {
+	Version uint64
+	KeyID   uint32
+	// Header is the encryption header of the replica, with it the data key
+	// can be wrapped again without sending the whole object
+	Header []byte
+}
+
+// MessageRewrapFile hands a peer a new encryption header for the replica
+// of Key, wrapping the same data key, together with the checksum and the
+// sealed metadata of the replica that result
+type MessageRewrapFile struct {
+	Key      string
+	Header   []byte
+	Checksum []byte
+	Meta     Metadata
+}
+
+// setReplica records that the peer called peer holds r of the object for
+// key
+func (s *Store) setReplica(key, peer string, r replica) error {
+	return s.index.update(key, func(rec *indexRecord) bool {
+		rec.Replicas = maps.Clone(rec.Replicas)
+		if rec.Replicas == nil {
+			rec.Replicas = make(map[string]replica)
+		}
+		rec.Replicas[peer] = r
+		return true
+	})
+}
+
+// recordReplica records that peer received up
+func (fs *FileServer) recordReplica(peer p2p.Peer, up *upload) {
+	r := replica{Version: up.Meta.Version, KeyID: up.KeyID, Header: up.Header}
+	if err := fs.store.setReplica(up.Key, fs.peerName(peer), r); err != nil {
+		log.Printf("[%s] recording the replica of %s on %s: %s", fs.Transport.Addr(), up.Key, peer.RemoteAddr(), err)
+	}
+}
+
+// setReplicaKey records that the replicas of version of the object for key
+// are encrypted with keyID, a newer version is left alone
+func (s *Store) setReplicaKey(key string, version uint64, keyID uint32) error {
+	return s.index.update(key, func(rec *indexRecord) bool {
+		if rec.Meta.Version != version {
+			return false
+		}
+		rec.ReplicaKey = keyID
+		return true
+	})
+}
+
+// RotateKey makes a fresh key current for everything encrypted from now on
+// and starts encrypting the existing objects with it in the background.
+// The old keys keep decrypting what they encrypted until they are retired.
+// It returns the id of the new key.
+func (fs *FileServer) RotateKey() (uint32, error) {
+	id, err := fs.keys.Rotate()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[%s] rotated to key %d", fs.Transport.Addr(), id)
+
+	select {
+	case fs.rekeych <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// RetireKey removes the key with the given id from the keyring, which is
+// only allowed once nothing depends on it anymore
+func (fs *FileServer) RetireKey(id uint32) error {
+	status := fs.KeyStatus()
+	if !slices.Contains(status.Retirable, id) {
+		return fmt.Errorf("key %d can't be retired, %d objects still depend on it", id, status.Pending[id]+status.Pending[0])
+	}
+	return fs.keys.Retire(id)
+}
+
+// KeyStatus returns which keys are still needed by the objects of this
+// node, encrypted at rest or pushed to peers
+func (fs *FileServer) KeyStatus() KeyStatus {
+	var (
+		current, _ = fs.keys.Current()
+		address    = fs.Transport.Addr()
+		status     = KeyStatus{Current: current, Pending: make(map[uint32]int)}
+	)
+
+	for _, st := range []*Store{fs.store, fs.cache.store} {
+		for _, rec := range st.index.records() {
+			needed := make(map[uint32]bool)
+			if rec.Sealed && rec.KeyID != current {
+				needed[rec.KeyID] = true
+			}
+			if st == fs.store && rec.Meta.Owner == address {
+				if rec.ReplicaKey != current {
+					needed[rec.ReplicaKey] = true
+				}
+				for _, r := range rec.Replicas {
+					if r.KeyID != current {
+						needed[r.KeyID] = true
+					}
+				}
+			}
+			for id := range needed {
+				status.Pending[id]++
+			}
+		}
+	}
+
+	for _, id := range fs.keys.IDs() {
+		if id != current && status.Pending[id] == 0 && status.Pending[0] == 0 {
+			status.Retirable = append(status.Retirable, id)
+		}
+	}
+	return status
+}
+
+// Rekey makes a single pass moving everything off the old keys: objects
+// encrypted at rest are encrypted again with the current key and the
+// replicas of the objects this node owns are moved to it on the peers.
+// It returns what still depends on old keys afterwards.
+func (fs *FileServer) Rekey() KeyStatus {
+	fs.rekeyLock.Lock()
+	defer fs.rekeyLock.Unlock()
+
+	var (
+		current, _ = fs.keys.Current()
+		address    = fs.Transport.Addr()
+	)
+
+	for _, st := range []*Store{fs.store, fs.cache.store} {
+		if st.Keys == nil {
+			continue
+		}
+		for _, rec := range st.index.records() {
+			if rec.Sealed && rec.KeyID == current || rec.Blob != "" {
+				continue
+			}
+			if err := st.reseal(rec.Meta.Key); err != nil {
+				log.Printf("[%s] encrypting %s with key %d: %s", address, rec.Meta.Key, current, err)
+			}
+		}
+	}
+
+	for _, rec := range fs.store.index.records() {
+		if rec.Meta.Owner != address {
+			continue
+		}
+		if err := fs.rekeyReplicas(&rec, current); err != nil {
+			log.Printf("[%s] encrypting %s with key %d: %s", address, rec.Meta.Key, current, err)
+		}
+	}
+
+	return fs.KeyStatus()
+}
+
+// rekeyReplicas moves the replicas of the object rec describes to the key
+// current on the peers that are connected. A replica of the latest version
+// only gets its data key wrapped again, anything else is pushed again.
+func (fs *FileServer) rekeyReplicas(rec *indexRecord, current uint32) error {
+	var (
+		up       *upload
+		complete = true
+		placed   = make(map[string]bool)
+	)
+	for _, peer := range fs.placement(rec.Meta.Size) {
+		placed[fs.peerName(peer)] = true
+	}
+	for _, peer := range fs.peerList() {
+		//a peer holding a replica keeps it whether or not it has room left,
+		//one without gets a replica the way replicate would place it
+		r, ok := rec.Replicas[fs.peerName(peer)]
+		if ok && r.KeyID == current || !ok && (rec.ReplicaKey == current || !placed[fs.peerName(peer)]) {
+			continue
+		}
+
+		if ok && r.Version == rec.Meta.Version {
+			err := fs.rewrap(peer, &rec.Meta, r)
+			if err == nil {
+				continue
+			}
+			log.Printf("[%s] wrapping the key of %s on %s again: %s", fs.Transport.Addr(), rec.Meta.Key, peer.RemoteAddr(), err)
+		}
+
+		if up == nil {
+			var err error
+			if up, err = fs.newUpload(rec.Meta.Key, rec.Meta.Size); err != nil {
+				return err
+			}
+		}
+		if !fs.replicateTo([]p2p.Peer{peer}, up) {
+			complete = false
+		}
+	}
+
+	if !complete || rec.ReplicaKey == current {
+		return nil
+	}
+	return fs.store.setReplicaKey(rec.Meta.Key, rec.Meta.Version, current)
+}
+
+// rewrap replaces the header of the replica r peer holds of the object
+// meta describes with one wrapping its data key with the current key. The
+// segments stay as they are, only the header and the sealed metadata go
+// over the network.
+func (fs *FileServer) rewrap(peer p2p.Peer, meta *Metadata, r replica) error {
+	hdr, err := parseEncHeader(r.Header)
+	if err != nil {
+		return err
+	}
+	dek, err := hdr.dataKey(fs.keys)
+	if err != nil {
+		return err
+	}
+	//a convergent header does not depend on the keyring, only the sealed
+	//metadata does
+	if hdr.keyID() != convergentKeyID {
+		current, kek := fs.keys.Current()
+		hdr.Wraps = nil
+		if err := hdr.wrap(current, kek, dek); err != nil {
+			return err
+		}
+	}
+	up, err := fs.uploadWith(meta.Key, meta.Size, hdr, dek)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageRewrapFile{
+			Key:      up.Replica.Key,
+			Header:   up.Header,
+			Checksum: up.Checksum,
+			Meta:     up.Replica,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	result := &uploadResult{}
+	if _, err := readFrame(peer, result); err != nil {
+		return err
+	}
+	if result.Failed != "" {
+		return errors.New(result.Failed)
+	}
+
+	fs.recordReplica(peer, up)
+	return nil
+}
+
+func (fs *FileServer) handleMessageRewrapFile(from string, msg MessageRewrapFile) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	err := fs.rewrapReplica(from, msg)
+	result := &uploadResult{}
+	if err != nil {
+		result.Failed = err.Error()
+	}
+	if werr := fs.sendFrame(peer, result); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// rewrapReplica puts the header of msg in front of the segments of the
+// replica it names, which is only done for the owner of the replica
+func (fs *FileServer) rewrapReplica(from string, msg MessageRewrapFile) error {
+	if err := fs.checkOwner(from, msg.Key); err != nil {
+		return err
+	}
+	hdr, err := parseEncHeader(msg.Header)
+	if err != nil {
+		return err
+	}
+
+	_, r, err := fs.store.read(msg.Key, false)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	old, err := readEncHeader(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(old.ad(), hdr.ad()) {
+		return fmt.Errorf("the new header of %s does not belong to its segments", msg.Key)
+	}
+
+	meta := msg.Meta
+	rest := io.MultiReader(bytes.NewReader(msg.Header), r)
+	if hdr.keyID() == convergentKeyID && msg.Checksum != nil {
+		_, err = fs.store.putShared(&meta, msg.Checksum, rest)
+	} else {
+		_, err = fs.store.put(&meta, msg.Checksum, rest, nil)
+	}
+	return err
+}
+
+func (fs *FileServer) rekeyLoop() {
+	ticker := time.NewTicker(defaultRekeyInterval)
+	defer ticker.Stop()
+
+	reported := make(map[uint32]bool)
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.rekeych:
+		case <-fs.quitch:
+			return
+		}
+		if len(fs.keys.IDs()) < 2 {
+			continue
+		}
+
+		status := fs.Rekey()
+		for _, id := range status.Retirable {
+			if !reported[id] {
+				log.Printf("[%s] key %d is no longer used and can be retired", fs.Transport.Addr(), id)
+				reported[id] = true
+			}
+		}
+	}
+}
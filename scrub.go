@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// quarantineDir is the folder inside the storage root corrupt objects are
+// moved to by the scrubber
+const quarantineDir = ".quarantine"
+
+// maxScrubFindings is how many findings are kept in the scrub stats
+const maxScrubFindings = 100
+
+// ScrubOpts configures the background scrubber of a FileServer
+type ScrubOpts struct {
+	// Interval between two passes over the store, the scrubber does not
+	// run in the background when it is zero
+	Interval time.Duration
+	// BytesPerSecond limits how fast objects are read, zero is unlimited
+	BytesPerSecond int64
+}
+
+// ScrubFinding is a corrupt object found by the scrubber
+type ScrubFinding struct {
+	Key    string
+	Time   time.Time
+	Healed bool
+	Err    string
+}
+
+// ScrubStats reports the progress and the findings of the scrubber, the
+// counters are those of the running or else the last pass
+type ScrubStats struct {
+	Running      bool
+	Passes       int
+	Objects      int
+	Bytes        int64
+	Corrupt      int
+	Healed       int
+	LastStarted  time.Time
+	LastFinished time.Time
+	Findings     []ScrubFinding
+}
+
+// verify reads the whole object for key through w and returns the number
+// of bytes read, a corrupt object returns a *CorruptionError
+func (s *Store) verify(key string, w io.Writer) (int64, error) {
+	_, r, err := s.read(key, false)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	return io.Copy(w, r)
+}
+
+// Quarantine moves the object for key out of the store into the quarantine
+// folder, where it is kept for inspection next to its metadata
+func (s *Store) Quarantine(key string) (string, error) {
+	dir := s.Root + string(os.PathSeparator) + quarantineDir
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	dst := dir + string(os.PathSeparator) + pathKey.fileName + "-" + time.Now().Format("20060102T150405.000")
+
+	b, _ := s.locate(key)
+	_, r, err := b.Get(pathKey.FilePath())
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	if err := b.Delete(pathKey.FilePath()); err != nil {
+		return "", err
+	}
+	if meta, ok := s.index.get(key); ok {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(dst+".meta", b, 0o644); err != nil {
+			return "", err
+		}
+	}
+	s.forget(key)
+	return dst, s.index.remove(key)
+}
+
+// throttledWriter discards what is written to it no faster than rate bytes
+// per second
+type throttledWriter struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.n += int64(len(p))
+	if t.rate > 0 {
+		due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+		if elapsed := time.Since(t.start); elapsed < due {
+			time.Sleep(due - elapsed)
+		}
+	}
+	return len(p), nil
+}
+
+func (fs *FileServer) scrubLoop() {
+	ticker := time.NewTicker(fs.Scrubber.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.Scrub(); err != nil {
+				log.Printf("[%s] scrub error: %s", fs.Transport.Addr(), err)
+			}
+		case <-fs.quitch:
+			return
+		}
+	}
+}
+
+// Scrub makes a single pass over the store, re-hashing every object. A
+// corrupt object is quarantined and a healthy copy is fetched from the
+// peers holding a replica.
+func (fs *FileServer) Scrub() error {
+	fs.scrubLock.Lock()
+	if fs.scrubStats.Running {
+		fs.scrubLock.Unlock()
+		return errors.New("scrub already running")
+	}
+	fs.scrubStats.Running = true
+	fs.scrubStats.Objects, fs.scrubStats.Bytes = 0, 0
+	fs.scrubStats.Corrupt, fs.scrubStats.Healed = 0, 0
+	fs.scrubStats.LastStarted = time.Now()
+	fs.scrubLock.Unlock()
+
+	defer func() {
+		fs.scrubLock.Lock()
+		fs.scrubStats.Running = false
+		fs.scrubStats.Passes++
+		fs.scrubStats.LastFinished = time.Now()
+		fs.scrubLock.Unlock()
+	}()
+
+	recs := fs.store.index.all()
+	tw := &throttledWriter{rate: fs.Scrubber.BytesPerSecond, start: time.Now()}
+	for _, rec := range recs {
+		select {
+		case <-fs.quitch:
+			return nil
+		default:
+		}
+		//a replica sharing a blob is checked with the blob
+		if fs.store.index.blob(rec.Key) != "" {
+			continue
+		}
+
+		n, err := fs.store.verify(rec.Key, tw)
+
+		fs.scrubLock.Lock()
+		fs.scrubStats.Objects++
+		fs.scrubStats.Bytes += n
+		fs.scrubLock.Unlock()
+
+		var corrupt *CorruptionError
+		if errors.As(err, &corrupt) || errors.Is(err, ErrCiphertext) {
+			fs.handleCorruptObject(rec)
+		} else if err != nil {
+			log.Printf("[%s] scrub could not read %s: %s", fs.Transport.Addr(), rec.Key, err)
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileServer) handleCorruptObject(rec *Metadata) {
+	finding := ScrubFinding{
+		Key:  rec.Key,
+		Time: time.Now(),
+	}
+
+	path, err := fs.store.Quarantine(rec.Key)
+	if err == nil {
+		log.Printf("[%s] quarantined corrupt object %s to %s", fs.Transport.Addr(), rec.Key, path)
+		err = fs.heal(rec)
+	}
+	if err != nil {
+		log.Printf("[%s] could not heal %s: %s", fs.Transport.Addr(), rec.Key, err)
+		finding.Err = err.Error()
+	} else {
+		log.Printf("[%s] healed %s from a replica", fs.Transport.Addr(), rec.Key)
+		finding.Healed = true
+	}
+
+	fs.scrubLock.Lock()
+	defer fs.scrubLock.Unlock()
+
+	fs.scrubStats.Corrupt++
+	if finding.Healed {
+		fs.scrubStats.Healed++
+	}
+	fs.scrubStats.Findings = append(fs.scrubStats.Findings, finding)
+	if n := len(fs.scrubStats.Findings); n > maxScrubFindings {
+		fs.scrubStats.Findings = fs.scrubStats.Findings[n-maxScrubFindings:]
+	}
+}
+
+// heal fetches a copy of the object described by rec from the peers. Peers
+// holding the same bytes are used as they are, a copy we pushed to them
+// ourselves is encrypted and gets decrypted back into the plain object.
+// A blob is fetched by the key of a replica sharing it.
+func (fs *FileServer) heal(rec *Metadata) error {
+	remote := fs.remoteKey(rec)
+	if isBlobKey(rec.Key) {
+		aliases := fs.store.index.aliases(rec.Key)
+		if len(aliases) == 0 {
+			return fmt.Errorf("no replica shares %s", rec.Key)
+		}
+		remote = aliases[0]
+	}
+
+	sf, _, err := fs.fetch(fs.store, rec.Key, remote, rec.Checksum)
+	if err != nil {
+		return err
+	}
+
+	sum, err := sf.Checksum()
+	if err != nil {
+		sf.Close()
+		return err
+	}
+	if bytes.Equal(sum, rec.Checksum) {
+		return sf.Publish(rec.Checksum, *rec)
+	}
+
+	if _, err := sf.PublishDecrypt(fs.keys, rec.Checksum, *rec); err != nil {
+		sf.Discard()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+// Package seal encrypts streams in segments of SegmentSize bytes with
+// AES-GCM. The nonce of a segment is a prefix picked for the stream, the
+// segment counter and a flag set only on the final segment, so segments
+// can't be reordered, dropped or cut off at the end without the decryption
+// failing. Every segment is authenticated together with additional data
+// that binds it to the stream, what it holds is up to the caller, as is
+// the header a stream is stored with.
+//
+//	segment: sealed plaintext | 16 byte tag
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SegmentSize   = 64 << 10
+	TagSize       = 16
+	SegmentLength = SegmentSize + TagSize
+	PrefixSize    = 7
+)
+
+// ErrCiphertext is returned when encrypted data fails to authenticate, it
+// was corrupted, tampered with or truncated
+var ErrCiphertext = errors.New("encrypted data failed to authenticate")
+
+// NewAEAD returns AES-GCM under key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealedSize returns the size of the segments of a stream of size bytes,
+// even an empty stream has a final segment
+func SealedSize(size int64) int64 {
+	segments := max((size+SegmentSize-1)/SegmentSize, 1)
+	return size + segments*TagSize
+}
+
+// PlainSize returns the size of the plaintext of size bytes of segments
+func PlainSize(size int64) int64 {
+	segments := max((size+SegmentLength-1)/SegmentLength, 1)
+	return max(size-segments*TagSize, 0)
+}
+
+// Cipher seals and opens the segments of a single stream
+type Cipher struct {
+	aead   cipher.AEAD
+	prefix [PrefixSize]byte
+	ad     []byte
+}
+
+// New returns the cipher of the stream with the data key key, the nonce
+// prefix prefix and ad as the additional data of every segment
+func New(key []byte, prefix [PrefixSize]byte, ad []byte) (*Cipher, error) {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead, prefix: prefix, ad: ad}, nil
+}
+
+func (c *Cipher) nonce(segment uint64, last bool) []byte {
+	nonce := make([]byte, 0, PrefixSize+5)
+	nonce = append(nonce, c.prefix[:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(segment))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Open decrypts the consecutive sealed segments in sealed, the first of
+// which is segment first. Whether a segment is the final one of the stream
+// can't be told from a range alone, so a segment that fails to open as an
+// inner one is tried as the final one.
+func (c *Cipher) Open(first int64, sealed []byte) ([]byte, error) {
+	plain := make([]byte, 0, len(sealed))
+	for i := uint64(first); len(sealed) > 0; i++ {
+		n := min(len(sealed), SegmentLength)
+		out, err := c.aead.Open(plain[len(plain):], c.nonce(i, false), sealed[:n], c.ad)
+		if err != nil {
+			out, err = c.aead.Open(plain[len(plain):], c.nonce(i, true), sealed[:n], c.ad)
+			if err == nil && n < len(sealed) {
+				err = errors.New("data after the final segment")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: segment %d", ErrCiphertext, i)
+		}
+		plain = plain[:len(plain)+len(out)]
+		sealed = sealed[n:]
+	}
+	return plain, nil
+}
+
+// EncryptingWriter encrypts what is written to it into W, header first when
+// there is one and then the sealed segments. A segment is only sealed once
+// it is known whether more follows, so Close has to be called to write the
+// final one. Write counts plaintext bytes, Written the bytes written to W.
+type EncryptingWriter struct {
+	W io.Writer
+
+	c       *Cipher
+	header  []byte
+	segment uint64
+	plain   []byte
+	sealed  []byte
+	written int64
+	err     error
+}
+
+var errWriterClosed = errors.New("write to closed EncryptingWriter")
+
+// NewWriter returns a writer encrypting into w that starts with header
+func (c *Cipher) NewWriter(w io.Writer, header []byte) *EncryptingWriter {
+	return c.newWriter(w, header, 0)
+}
+
+// newWriter is NewWriter for plaintext starting at segment
+func (c *Cipher) newWriter(w io.Writer, header []byte, segment int64) *EncryptingWriter {
+	return &EncryptingWriter{
+		W:       w,
+		c:       c,
+		header:  header,
+		segment: uint64(segment),
+		plain:   make([]byte, 0, SegmentSize),
+		sealed:  make([]byte, 0, SegmentLength),
+	}
+}
+
+func (e *EncryptingWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if e.err != nil {
+			return n, e.err
+		}
+		// more follows, so the buffered segment is not the final one
+		if len(e.plain) == SegmentSize {
+			e.flush(false)
+			continue
+		}
+		m := copy(e.plain[len(e.plain):SegmentSize], p)
+		e.plain = e.plain[:len(e.plain)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, e.err
+}
+
+// Close seals the final segment and closes W when it is an io.Closer. The
+// writer can't be used afterwards.
+func (e *EncryptingWriter) Close() error {
+	if e.err == errWriterClosed {
+		return nil
+	}
+	if e.err != nil {
+		return e.err
+	}
+	if e.flush(true); e.err != nil {
+		return e.err
+	}
+	e.err = errWriterClosed
+	if c, ok := e.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Written returns the number of bytes written to W
+func (e *EncryptingWriter) Written() int64 {
+	return e.written
+}
+
+// flush seals the buffered plaintext as the next segment and writes it to
+// W, preceded by the header before the first segment
+func (e *EncryptingWriter) flush(last bool) {
+	if e.header != nil {
+		if e.write(e.header); e.err != nil {
+			return
+		}
+		e.header = nil
+	}
+	e.write(e.c.aead.Seal(e.sealed[:0], e.c.nonce(e.segment, last), e.plain, e.c.ad))
+	e.segment++
+	e.plain = e.plain[:0]
+}
+
+func (e *EncryptingWriter) write(b []byte) {
+	n, err := e.W.Write(b)
+	e.written += int64(n)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	e.err = err
+}
+
+// Encrypt returns a reader yielding header and the sealed segments of the
+// plaintext read from r, which holds the plaintext from the start of
+// segment onwards. It pulls r through an EncryptingWriter.
+func (c *Cipher) Encrypt(r io.Reader, header []byte, segment int64) io.Reader {
+	er := &encryptReader{
+		r:     r,
+		plain: make([]byte, SegmentSize),
+	}
+	er.w = c.newWriter(&er.out, header, segment)
+	return er
+}
+
+// encryptReader is what Encrypt returns
+type encryptReader struct {
+	r     io.Reader
+	w     *EncryptingWriter
+	plain []byte
+	out   bytes.Buffer
+	done  bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := e.r.Read(e.plain)
+		if _, werr := e.w.Write(e.plain[:n]); werr != nil {
+			return 0, werr
+		}
+		if err == io.EOF {
+			e.done = true
+			err = e.w.Close()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return e.out.Read(p)
+}
+
+// DecryptingReader yields the plaintext of the segments read from R, it
+// fails with ErrCiphertext as soon as a segment does not authenticate and
+// when R ends before the final segment. Read counts plaintext bytes.
+type DecryptingReader struct {
+	c       *Cipher
+	r       *bufio.Reader
+	segment uint64
+	sealed  []byte
+	plain   []byte
+	out     []byte
+	done    bool
+}
+
+// NewReader returns a reader decrypting the segments read from r, which
+// has to start with the first segment
+func (c *Cipher) NewReader(r io.Reader) *DecryptingReader {
+	return &DecryptingReader{
+		c:      c,
+		r:      bufio.NewReaderSize(r, SegmentLength+1),
+		sealed: make([]byte, SegmentLength),
+		plain:  make([]byte, 0, SegmentSize),
+	}
+}
+
+func (d *DecryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment, it looks one byte ahead to know
+// whether it is the final one
+func (d *DecryptingReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err == io.EOF {
+		return fmt.Errorf("%w: stream ends before its final segment", ErrCiphertext)
+	}
+	last := err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.c.aead.Open(d.plain[:0], d.c.nonce(d.segment, last), d.sealed[:n], d.c.ad)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d", ErrCiphertext, d.segment)
+	}
+	d.out = plain
+	d.segment++
+	d.done = last
+	return nil
+}
@@ -0,0 +1,86 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newCipher(t *testing.T) *Cipher {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	var prefix [PrefixSize]byte
+	rand.Read(prefix[:])
+	c, err := New(key, prefix, []byte("stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWriterAndReader(t *testing.T) {
+	c := newCipher(t)
+	header := []byte("header")
+
+	for _, size := range []int{0, 1, SegmentSize, 2*SegmentSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		enc := new(bytes.Buffer)
+		ew := c.NewWriter(enc, header)
+		if n, err := io.Copy(ew, bytes.NewReader(data)); err != nil || n != int64(size) {
+			t.Fatalf("size %d: wrote %d bytes (%v)", size, n, err)
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if ew.Written() != int64(enc.Len()) || ew.Written() != int64(len(header))+SealedSize(int64(size)) {
+			t.Errorf("size %d: wrote %d sealed bytes, buffer holds %d", size, ew.Written(), enc.Len())
+		}
+		if PlainSize(int64(enc.Len()-len(header))) != int64(size) {
+			t.Errorf("size %d: have plain size %d", size, PlainSize(int64(enc.Len()-len(header))))
+		}
+
+		// the reader yields the same bytes as the writer
+		pulled, err := io.ReadAll(c.Encrypt(bytes.NewReader(data), header, 0))
+		if err != nil || !bytes.Equal(pulled, enc.Bytes()) {
+			t.Errorf("size %d: Encrypt differs from the writer (%v)", size, err)
+		}
+
+		sealed := enc.Bytes()[len(header):]
+		out, err := io.ReadAll(c.NewReader(bytes.NewReader(sealed)))
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("size %d: decrypted %d bytes (%v)", size, len(out), err)
+		}
+		if size > 0 {
+			_, err := io.ReadAll(c.NewReader(bytes.NewReader(sealed[:len(sealed)-1])))
+			if !errors.Is(err, ErrCiphertext) {
+				t.Errorf("size %d: truncated stream gave %v", size, err)
+			}
+		}
+	}
+}
+
+func TestEncryptFromSegment(t *testing.T) {
+	c := newCipher(t)
+	data := make([]byte, 3*SegmentSize+5)
+	rand.Read(data)
+
+	sealed, err := io.ReadAll(c.Encrypt(bytes.NewReader(data), nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for first := int64(0); first < 4; first++ {
+		rest, err := io.ReadAll(c.Encrypt(bytes.NewReader(data[first*SegmentSize:]), nil, first))
+		if err != nil || !bytes.Equal(rest, sealed[first*SegmentLength:]) {
+			t.Errorf("sealing from segment %d gave other bytes (%v)", first, err)
+		}
+		plain, err := c.Open(first, rest)
+		if err != nil || !bytes.Equal(plain, data[first*SegmentSize:]) {
+			t.Errorf("opening from segment %d: %v", first, err)
+		}
+	}
+}
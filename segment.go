@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxSegmentSize = 64 << 20
+	defaultCompactRatio   = 0.5
+)
+
+// SegmentOpts configures a SegmentBackend
+type SegmentOpts struct {
+	// Dir is the folder holding the segment files
+	Dir string
+	// MaxSegmentSize is the size after which a new segment is started,
+	// defaults to 64MiB
+	MaxSegmentSize int64
+	// CompactRatio is the share of a sealed segment taken by replaced or
+	// deleted objects at which the segment is compacted, defaults to 0.5
+	CompactRatio float64
+	Durability   Durability
+}
+
+// segment is one file of a SegmentBackend, records are laid out the same
+// way as in a pack
+type segment struct {
+	id   int
+	file *os.File
+	// size is the number of bytes in the file and dead the number of
+	// those taken by records that no longer matter
+	size int64
+	dead int64
+	// refs counts the open readers, a retired segment is closed once the
+	// last one is done
+	refs    int
+	retired bool
+}
+
+func (sg *segment) garbage() float64 {
+	if sg.size == 0 {
+		return 0
+	}
+	return float64(sg.dead) / float64(sg.size)
+}
+
+type segmentEntry struct {
+	seg    *segment
+	offset int64
+	size   int64
+	// length is the size of the whole record
+	length int64
+}
+
+// SegmentBackend is a log structured backend for large numbers of small
+// objects. Objects are appended to the active segment file, once it grows
+// past MaxSegmentSize it is sealed and a new one is started. The segments
+// are scanned in order on open to find the latest record of every name.
+// A sealed segment with enough replaced or deleted records is compacted:
+// its live records are appended to the active segment and the file is
+// removed.
+type SegmentBackend struct {
+	SegmentOpts
+
+	// writeLock serializes appending and compacting
+	writeLock sync.Mutex
+	mu        sync.RWMutex
+	segments  []*segment
+	entries   map[string]segmentEntry
+}
+
+func NewSegmentBackend(opts SegmentOpts) (*SegmentBackend, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = defaultCompactRatio
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	b := &SegmentBackend{
+		SegmentOpts: opts,
+		entries:     make(map[string]segmentEntry),
+	}
+	if err := b.load(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *SegmentBackend) segmentPath(id int) string {
+	return b.Dir + string(os.PathSeparator) + fmt.Sprintf("%08d.seg", id)
+}
+
+func (b *SegmentBackend) load() error {
+	paths, err := filepath.Glob(b.Dir + string(os.PathSeparator) + "*.seg")
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%08d.seg", &id); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		sg := &segment{id: id, file: f}
+		b.segments = append(b.segments, sg)
+
+		end, err := scanRecords(f, func(name string, offset, size int64) {
+			length := offset - sg.size
+			if size != packTombstone {
+				length += size
+			}
+			sg.size += length
+
+			b.kill(name)
+			if size == packTombstone {
+				sg.dead += length
+				return
+			}
+			b.entries[name] = segmentEntry{seg: sg, offset: offset, size: size, length: length}
+		})
+		if err != nil {
+			return err
+		}
+		//whatever follows the last complete record was torn by a crash
+		if err := f.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	if len(b.segments) == 0 {
+		return b.roll()
+	}
+	return nil
+}
+
+// kill marks the current record of name as dead and returns its segment,
+// it has to be called with the lock held
+func (b *SegmentBackend) kill(name string) *segment {
+	e, ok := b.entries[name]
+	if !ok {
+		return nil
+	}
+	e.seg.dead += e.length
+	delete(b.entries, name)
+	return e.seg
+}
+
+func (b *SegmentBackend) active() *segment {
+	return b.segments[len(b.segments)-1]
+}
+
+// roll starts a new active segment, it has to be called with writeLock held
+func (b *SegmentBackend) roll() error {
+	id := 1
+	if len(b.segments) > 0 {
+		id = b.active().id + 1
+	}
+
+	f, err := os.OpenFile(b.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if b.Durability == DurabilityFull {
+		if err := syncDir(b.Dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.segments = append(b.segments, &segment{id: id, file: f})
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *SegmentBackend) Put(name string, r io.Reader) (int64, error) {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	n, err := b.append(name, r)
+	if err != nil {
+		return 0, err
+	}
+	return n, b.maybeCompact()
+}
+
+// append writes a record for name to the active segment, it has to be
+// called with writeLock held
+func (b *SegmentBackend) append(name string, r io.Reader) (int64, error) {
+	if b.active().size >= b.MaxSegmentSize {
+		if err := b.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	sg := b.active()
+	n, err := appendRecord(sg.file, sg.size, name, r, b.Durability)
+	if err != nil {
+		//leave no trace of the failed record
+		sg.file.Truncate(sg.size)
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	length := packHeaderSize + int64(len(name)) + n
+	b.kill(name)
+	b.entries[name] = segmentEntry{
+		seg:    sg,
+		offset: sg.size + packHeaderSize + int64(len(name)),
+		size:   n,
+		length: length,
+	}
+	sg.size += length
+	return n, nil
+}
+
+func (b *SegmentBackend) Delete(name string) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	if _, err := b.lookup(name); err != nil {
+		return nil
+	}
+	if err := b.tombstone(name); err != nil {
+		return err
+	}
+	return b.maybeCompact()
+}
+
+// tombstone writes a tombstone for name to the active segment, it has to
+// be called with writeLock held
+func (b *SegmentBackend) tombstone(name string) error {
+	sg := b.active()
+	n, err := appendTombstone(sg.file, sg.size, name, b.Durability)
+	if err != nil {
+		sg.file.Truncate(sg.size)
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.kill(name)
+	sg.size += n
+	//a tombstone only matters as long as an older record of the name
+	//might still be around
+	sg.dead += n
+	return nil
+}
+
+// maybeCompact compacts every sealed segment with too much garbage, it
+// has to be called with writeLock held
+func (b *SegmentBackend) maybeCompact() error {
+	for _, sg := range b.sealed() {
+		if sg.garbage() >= b.CompactRatio {
+			if err := b.compact(sg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compact compacts every sealed segment holding any garbage
+func (b *SegmentBackend) Compact() error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	for _, sg := range b.sealed() {
+		if sg.dead > 0 {
+			if err := b.compact(sg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *SegmentBackend) sealed() []*segment {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return append([]*segment(nil), b.segments[:len(b.segments)-1]...)
+}
+
+// compact moves the live records of sg to the active segment and removes
+// sg. Tombstones are carried over unless sg is the oldest segment, in
+// which case there is no older record left for them to hide.
+func (b *SegmentBackend) compact(sg *segment) error {
+	b.mu.RLock()
+	oldest := b.segments[0] == sg
+	b.mu.RUnlock()
+
+	var (
+		live       []string
+		tombstones []string
+	)
+	_, err := scanRecords(sg.file, func(name string, offset, size int64) {
+		if size == packTombstone {
+			if !oldest {
+				tombstones = append(tombstones, name)
+			}
+			return
+		}
+		b.mu.RLock()
+		e, ok := b.entries[name]
+		b.mu.RUnlock()
+		if ok && e.seg == sg && e.offset == offset {
+			live = append(live, name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range live {
+		e, err := b.lookup(name)
+		if err != nil {
+			continue
+		}
+		r := io.NewSectionReader(sg.file, e.offset, e.size)
+		if _, err := b.append(name, r); err != nil {
+			return err
+		}
+	}
+	for _, name := range tombstones {
+		if _, err := b.lookup(name); err == nil {
+			continue
+		}
+		if err := b.tombstone(name); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(b.segmentPath(sg.id)); err != nil {
+		return err
+	}
+	if b.Durability == DurabilityFull {
+		if err := syncDir(b.Dir); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, s := range b.segments {
+		if s == sg {
+			b.segments = append(b.segments[:i], b.segments[i+1:]...)
+			break
+		}
+	}
+	sg.retired = true
+	if sg.refs == 0 {
+		sg.file.Close()
+	}
+	return nil
+}
+
+func (b *SegmentBackend) lookup(name string) (segmentEntry, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.entries[name]
+	if !ok {
+		return e, fmt.Errorf("object %s: %w", name, os.ErrNotExist)
+	}
+	return e, nil
+}
+
+// acquire looks up name and keeps its segment open until release is called
+func (b *SegmentBackend) acquire(name string) (segmentEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[name]
+	if !ok {
+		return e, fmt.Errorf("object %s: %w", name, os.ErrNotExist)
+	}
+	e.seg.refs++
+	return e, nil
+}
+
+func (b *SegmentBackend) release(sg *segment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sg.refs--
+	if sg.retired && sg.refs == 0 {
+		sg.file.Close()
+	}
+}
+
+type segmentReader struct {
+	*io.SectionReader
+	b    *SegmentBackend
+	seg  *segment
+	once sync.Once
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(func() { r.b.release(r.seg) })
+	return nil
+}
+
+func (b *SegmentBackend) Get(name string) (int64, io.ReadCloser, error) {
+	e, err := b.acquire(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return e.size, &segmentReader{
+		SectionReader: io.NewSectionReader(e.seg.file, e.offset, e.size),
+		b:             b,
+		seg:           e.seg,
+	}, nil
+}
+
+func (b *SegmentBackend) Stat(name string) (int64, error) {
+	e, err := b.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+func (b *SegmentBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var names []string
+	for name := range b.entries {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *SegmentBackend) ReadAt(name string, p []byte, offset int64) (int, error) {
+	e, err := b.acquire(name)
+	if err != nil {
+		return 0, err
+	}
+	defer b.release(e.seg)
+
+	return io.NewSectionReader(e.seg.file, e.offset, e.size).ReadAt(p, offset)
+}
+
+// Close closes every segment file
+func (b *SegmentBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sg := range b.segments {
+		sg.file.Close()
+	}
+	return nil
+}
@@ -2,23 +2,60 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"os"
 	"sync"
 	"time"
 
 	"dfs/p2p"
+	"dfs/seal"
 )
 
 type FileServerOpts struct {
-	EncKey            []byte
+	// Keyring is where the keys this node encrypts with are kept, it is
+	// loaded when the server is created
+	Keyring           KeyringOpts
 	storageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	Scrubber          ScrubOpts
+	// Backend holds the bytes of the stored objects, see StoreOpts
+	Backend Backend
+	// MaxBytes and MaxObjects limit what this node stores, see StoreOpts
+	MaxBytes   int64
+	MaxObjects int
+	// Tiers and TierInterval configure tiered storage, see StoreOpts
+	Tiers        []Tier
+	TierInterval time.Duration
+	// ReapInterval is how often expired objects are deleted, defaults to a
+	// minute
+	ReapInterval time.Duration
+	// CacheSize is the number of bytes kept of objects fetched from peers,
+	// defaults to 256MiB
+	CacheSize int64
+	// EncryptAtRest encrypts everything this node stores with its keyring,
+	// owned objects, replicas and the cache alike, see StoreOpts
+	EncryptAtRest bool
+	// Convergent derives the data key of the replicas pushed to peers from
+	// their content and the cluster secret of the keyring, so the same
+	// content pushed by different nodes is stored as identical bytes. It
+	// lets anyone holding the cluster secret read the replicas.
+	Convergent bool
+	// Sign signs the objects stored through this node with the signing key
+	// of its keyring
+	Sign bool
+	// TrustedKeys are the writers whose objects Get accepts, every object
+	// has to be signed by one of them. Without trusted keys unsigned objects
+	// are accepted, signed ones still have to verify.
+	TrustedKeys []ed25519.PublicKey
 }
 
 type FileServer struct {
@@ -26,22 +63,93 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
-
-	store  *Store
+	// addrs holds the address every peer said hello with by the address
+	// of its connection
+	addrs map[string]string
+	conns map[p2p.Peer]*peerConn
+
+	// pending holds the uploads that could not be pushed to a peer by the
+	// peer's address and their key, they are resumed once the peer
+	// (re)connects
+	pendingLock sync.Mutex
+	pending     map[string]map[string]*upload
+
+	scrubLock  sync.Mutex
+	scrubStats ScrubStats
+
+	// capacities holds the capacity last advertised by every peer,
+	// advertised the capacity this node last advertised
+	capacityLock sync.Mutex
+	capacities   map[string]Capacity
+	advertised   Capacity
+
+	keys *Keyring
+	// rekeyLock keeps a single re-encryption pass running, rekeych starts
+	// one right away
+	rekeyLock sync.Mutex
+	rekeych   chan struct{}
+
+	store *Store
+	// cache holds objects fetched from peers apart from the owned ones
+	cache  *cache
 	quitch chan struct{}
 }
 
-func NewFileServer(opts *FileServerOpts) *FileServer {
+// Stats is a snapshot of what a FileServer is up to
+type Stats struct {
+	Peers    int
+	Capacity Capacity
+	Scrub    ScrubStats
+	Keys     KeyStatus
+}
+
+func NewFileServer(opts *FileServerOpts) (*FileServer, error) {
+	if opts.Keyring.Path == "" {
+		root := opts.storageRoot
+		if root == "" {
+			root = defaultRootFolder
+		}
+		opts.Keyring.Path = root + string(os.PathSeparator) + keyringDir + string(os.PathSeparator) + "keyring"
+	}
+	keys, err := OpenKeyring(opts.Keyring)
+	if err != nil {
+		return nil, fmt.Errorf("loading keyring: %w", err)
+	}
+
+	var storeKeys *Keyring
+	if opts.EncryptAtRest {
+		storeKeys = keys
+	}
 	storeOpts := StoreOpts{
 		Root:              opts.storageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Backend:           opts.Backend,
+		MaxBytes:          opts.MaxBytes,
+		MaxObjects:        opts.MaxObjects,
+		Tiers:             opts.Tiers,
+		TierInterval:      opts.TierInterval,
+		Keys:              storeKeys,
 	}
+	store := NewStore(storeOpts)
+	cacheStore := NewStore(StoreOpts{
+		Root:              store.Root + string(os.PathSeparator) + cacheDir,
+		PathTransformFunc: opts.PathTransformFunc,
+		Durability:        DurabilityNone,
+		Keys:              storeKeys,
+	})
 	return &FileServer{
 		FileServerOpts: *opts,
-		store:          NewStore(storeOpts),
+		keys:           keys,
+		rekeych:        make(chan struct{}, 1),
+		store:          store,
+		cache:          newCache(cacheStore, opts.CacheSize),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
-	}
+		addrs:          make(map[string]string),
+		conns:          make(map[p2p.Peer]*peerConn),
+		pending:        make(map[string]map[string]*upload),
+		capacities:     make(map[string]Capacity),
+	}, nil
 }
 
 type Message struct {
@@ -49,95 +157,323 @@ type Message struct {
 	Payload any
 }
 
+// MessageStoreFile announces that the bytes of the upload identified by ID
+// from Offset up to Size follow as a stream. Checksum is the sha256 of the
+// complete file the receiver ends up with
 type MessageStoreFile struct {
-	Key  string
-	Size int64
+	Key      string
+	ID       string
+	Size     int64
+	Offset   int64
+	Checksum []byte
+	Meta     Metadata
+}
+
+// MessageHello tells a peer the address of the sender, which is what the
+// sender records as the owner of the objects it writes
+type MessageHello struct {
+	Addr string
 }
 
+// MessageStatFile asks a peer for the metadata it holds for Key
+type MessageStatFile struct {
+	Key string
+}
+
+// MessageGetFile asks a peer for Length bytes of the file it holds for Key
+// starting at Offset. A Length of 0 reads up to the end of the file
 type MessageGetFile struct {
+	Key    string
+	Offset int64
+	Length int64
+}
+
+// MessageGetManifest asks a peer for the size and the per piece hashes of
+// the file it holds for Key
+type MessageGetManifest struct {
 	Key string
 }
 
+// Get returns the object for key from the local disk or else fetches it
+// from the peers into the cache. The signature of the object is checked
+// against the trusted keys before it is returned.
 func (fs *FileServer) Get(key string) (io.Reader, error) {
 	if fs.store.Has(key) {
 		log.Printf("[%s] serving file with key %s from local disk", fs.Transport.Addr(), key)
+		if err := fs.verifySigner(fs.store, key); err != nil {
+			return nil, err
+		}
 		_, r, err := fs.store.Read(key)
 		return r, err
 	}
-	log.Printf("[%s] dosen't have %s locally, looking over the network", fs.Transport.Addr(), key)
-	msg := Message{
-		Payload: MessageGetFile{
-			Key: key,
-		},
+	if fs.cache.has(key) {
+		if err := fs.verifySigner(fs.cache.store, key); err != nil {
+			return nil, err
+		}
 	}
+	if r, ok := fs.cache.get(key); ok {
+		log.Printf("[%s] serving file with key %s from the cache", fs.Transport.Addr(), key)
+		return r, nil
+	}
+	log.Printf("[%s] dosen't have %s locally, looking over the network", fs.Transport.Addr(), key)
 
-	if err := fs.broadcast(&msg); err != nil {
+	if _, err := fs.download(key); err != nil {
+		return nil, err
+	}
+	if err := fs.verifySigner(fs.cache.store, key); err != nil {
+		fs.cache.remove(key)
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 30)
+	_, r, err := fs.cache.store.Read(key)
+	return r, err
+}
 
-	for _, peer := range fs.peers {
-		//read the file size so we can limit the amount of bytes we read from
-		//the connection
-		var filesize int64
-		binary.Read(peer, binary.LittleEndian, &filesize)
-		if filesize == 0 {
-			return nil, fmt.Errorf("[%s] dosen't have file %s", peer.RemoteAddr(), key)
-		}
-		n, err := fs.store.WriteDecrypt(fs.EncKey, key, io.LimitReader(peer, filesize))
-		// n, err := fs.store.Write(key, io.LimitReader(peer, filesize))
-		if err != nil {
+// GetRange returns length bytes of the file for key starting at offset, a
+// length of 0 reads up to the end of the file. When the file is not on the
+// local disk only the requested range is fetched from a peer.
+func (fs *FileServer) GetRange(key string, offset, length int64) (io.Reader, error) {
+	if fs.store.Has(key) {
+		log.Printf("[%s] serving range of %s from local disk", fs.Transport.Addr(), key)
+		if err := fs.verifySigner(fs.store, key); err != nil {
 			return nil, err
 		}
+		_, r, err := fs.store.ReadRange(key, offset, length)
+		return r, err
+	}
+	if fs.cache.has(key) {
+		if err := fs.verifySigner(fs.cache.store, key); err != nil {
+			return nil, err
+		}
+		if _, r, err := fs.cache.store.ReadRange(key, offset, length); err == nil {
+			return r, nil
+		}
+	}
 
-		log.Printf("[%s] received %d bytes from %s:", fs.Transport.Addr(), n, peer.RemoteAddr())
-
-		peer.CloseStream()
+	// only the segments holding the range are fetched and opened
+	first := offset / seal.SegmentSize
+	skip := offset - first*seal.SegmentSize
+	var sealedLength int64
+	if length > 0 {
+		last := (offset + length - 1) / seal.SegmentSize
+		sealedLength = (last - first + 1) * seal.SegmentLength
 	}
-	_, r, err := fs.store.Read(key)
-	return r, err
-}
 
-func (fs *FileServer) Store(key string, r io.Reader) error {
 	var (
-		fileData = new(bytes.Buffer)
-		tee      = io.TeeReader(r, fileData)
+		wire    = fs.wireKey(key)
+		corrupt error
 	)
+	for _, peer := range fs.peerList() {
+		replica, err := fs.requestStat(peer, wire)
+		if err == nil && replica == nil {
+			continue
+		}
+		var meta *Metadata
+		if err == nil {
+			meta, err = fs.openMeta(replica)
+		}
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		if err := meta.verifySignature(fs.TrustedKeys); err != nil {
+			return nil, err
+		}
+
+		hdr, err := fs.requestHeader(peer, wire)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		sealed, err := fs.requestRange(peer, wire, hdr.sealedOffset(first), sealedLength)
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		encKey, err := hdr.dataKey(fs.keys)
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		c, err := hdr.cipher(encKey)
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		data, err := c.Open(first, sealed)
+		if err != nil {
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		data = data[min(skip, int64(len(data))):]
+		if length > 0 && int64(len(data)) > length {
+			data = data[:length]
+		}
+		//segments cut off at the end of a range open like any other, only
+		//the size of the object tells that some are missing
+		want := max(meta.Size-offset, 0)
+		if length > 0 {
+			want = min(want, length)
+		}
+		if int64(len(data)) < want {
+			corrupt = &CorruptionError{Key: key, Missing: want - int64(len(data))}
+			log.Printf("[%s] range of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), corrupt)
+			continue
+		}
 
-	size, err := fs.store.Write(key, tee)
+		log.Printf("[%s] received %d bytes of %s from %s", fs.Transport.Addr(), len(data), key, peer.RemoteAddr())
+		return bytes.NewReader(data), nil
+	}
+
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return nil, fmt.Errorf("[%s] no peer has file %s", fs.Transport.Addr(), key)
+}
 
+// requestHeader fetches the encryption header peers store in front of the
+// segments of the file for key, the fixed part first to learn its length
+func (fs *FileServer) requestHeader(peer p2p.Peer, key string) (*encHeader, error) {
+	b, err := fs.requestRange(peer, key, 0, int64(encFixedSize))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if len(b) == 0 {
+		return nil, os.ErrNotExist
+	}
+	size, err := encHeaderSize(b)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := fs.requestRange(peer, key, int64(encFixedSize), int64(size-encFixedSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseEncHeader(append(b, rest...))
+}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  key,
-			Size: size + 16,
-		},
+// Stat returns the metadata of the object for key, from the local store or
+// the cache or else from the first peer that has it
+func (fs *FileServer) Stat(key string) (*Metadata, error) {
+	if fs.store.Has(key) {
+		return fs.store.Stat(key)
 	}
-	if err := fs.broadcast(&msg); err != nil {
-		return err
+	if fs.cache.has(key) {
+		if meta, err := fs.cache.store.Stat(key); err == nil {
+			return meta, nil
+		}
 	}
 
-	time.Sleep(10 * time.Millisecond)
+	for _, peer := range fs.peerList() {
+		meta, err := fs.requestStat(peer, fs.wireKey(key))
+		if err == nil && meta != nil {
+			meta, err = fs.openMeta(meta)
+		}
+		if err != nil {
+			log.Printf("[%s] stat of %s from %s: %s", fs.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		if meta != nil {
+			return meta, nil
+		}
+	}
 
-	peers := []io.Writer{}
-	for _, peer := range fs.peers {
-		peers = append(peers, peer)
+	return nil, fmt.Errorf("[%s] no peer has file %s", fs.Transport.Addr(), key)
+}
+
+func (fs *FileServer) Store(key string, r io.Reader) error {
+	return fs.StoreWithMetadata(Metadata{Key: key}, r)
+}
+
+// StoreWithMetadata stores the object for meta.Key on the local disk and
+// pushes it to the peers, meta is replicated together with the object
+func (fs *FileServer) StoreWithMetadata(meta Metadata, r io.Reader) error {
+	key := meta.Key
+	if meta.Owner == "" {
+		meta.Owner = fs.Transport.Addr()
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(fs.EncKey, fileData, mw)
+
+	var (
+		size int64
+		err  error
+	)
+	if fs.Sign {
+		size, err = fs.store.WriteSigned(meta, fs.keys.signingKey(), r)
+	} else {
+		size, err = fs.store.WriteWithMetadata(meta, r)
+	}
+	if err != nil {
+		return err
+	}
+	fs.readvertise()
+
+	up, err := fs.newUpload(key, size)
 	if err != nil {
 		return err
 	}
-	fmt.Println("received an written to disk", n)
 
+	if fs.replicate(up) {
+		return fs.store.setReplicaKey(key, up.Meta.Version, up.KeyID)
+	}
 	return nil
 }
 
+// replicate pushes the upload to the peers picked for it, an interrupted
+// push is left pending to be resumed later. It reports whether every push
+// went through.
+func (fs *FileServer) replicate(up *upload) bool {
+	return fs.replicateTo(fs.placement(up.Size), up)
+}
+
+// replicateTo is replicate to the given peers
+func (fs *FileServer) replicateTo(peers []p2p.Peer, up *upload) bool {
+	complete := true
+	for _, peer := range peers {
+		if err := fs.push(peer, up); err != nil {
+			var quota *QuotaError
+			if errors.As(err, &quota) {
+				log.Printf("[%s] %s has no room for %s: %s", fs.Transport.Addr(), peer.RemoteAddr(), up.Key, err)
+				continue
+			}
+			log.Printf("[%s] upload of %s to %s interrupted: %s", fs.Transport.Addr(), up.Key, peer.RemoteAddr(), err)
+
+			fs.pendingLock.Lock()
+			addr := peer.RemoteAddr().String()
+			if fs.pending[addr] == nil {
+				fs.pending[addr] = make(map[string]*upload)
+			}
+			fs.pending[addr][up.Key] = up
+			fs.pendingLock.Unlock()
+			complete = false
+		}
+	}
+	return complete
+}
+
+// Stats returns a snapshot of the server's statistics
+func (fs *FileServer) Stats() Stats {
+	fs.peerLock.Lock()
+	peers := len(fs.peers)
+	fs.peerLock.Unlock()
+	keys := fs.KeyStatus()
+
+	fs.scrubLock.Lock()
+	defer fs.scrubLock.Unlock()
+
+	scrub := fs.scrubStats
+	scrub.Findings = append([]ScrubFinding(nil), fs.scrubStats.Findings...)
+
+	return Stats{
+		Peers:    peers,
+		Capacity: fs.store.Capacity(),
+		Scrub:    scrub,
+		Keys:     keys,
+	}
+}
+
 func (fs *FileServer) Stop() {
 	close(fs.quitch)
 }
@@ -149,6 +485,15 @@ func (fs *FileServer) Start() error {
 
 	fs.bootstrapNetwork()
 
+	if fs.Scrubber.Interval > 0 {
+		go fs.scrubLoop()
+	}
+	if len(fs.store.Tiers) > 1 {
+		go fs.tierLoop()
+	}
+	go fs.reapLoop()
+	go fs.rekeyLoop()
+
 	fs.loop()
 
 	return nil
@@ -162,12 +507,87 @@ func (fs *FileServer) OnPeer(p p2p.Peer) error {
 	fs.peers[p.RemoteAddr().String()] = p
 
 	log.Printf("[%s] connected with remote %s", fs.Transport.Addr(), p.RemoteAddr())
+
+	go func() {
+		msg := Message{Payload: MessageHello{Addr: fs.Transport.Addr()}}
+		if err := fs.send(p, &msg); err != nil {
+			log.Printf("[%s] saying hello to %s: %s", fs.Transport.Addr(), p.RemoteAddr(), err)
+		}
+		if err := fs.advertise(p); err != nil {
+			log.Printf("[%s] advertising capacity to %s: %s", fs.Transport.Addr(), p.RemoteAddr(), err)
+		}
+		fs.resumeUploads(p)
+	}()
+	return nil
+}
+
+// OnPeerDisconnect forgets a peer whose connection was dropped, peers we
+// dialed ourselves are dialed again until they are back
+func (fs *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	fs.peerLock.Lock()
+	delete(fs.peers, p.RemoteAddr().String())
+	delete(fs.addrs, p.RemoteAddr().String())
+	delete(fs.conns, p)
+	fs.peerLock.Unlock()
+
+	fs.capacityLock.Lock()
+	delete(fs.capacities, p.RemoteAddr().String())
+	fs.capacityLock.Unlock()
+
+	log.Printf("[%s] lost connection with remote %s", fs.Transport.Addr(), p.RemoteAddr())
+
+	if p.Outbound() {
+		go fs.redial(p.RemoteAddr().String())
+	}
+}
+
+func (fs *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	fs.addrs[from] = msg.Addr
 	return nil
 }
 
+// peerAddr returns the address the peer connected from from said hello
+// with, empty when it did not
+func (fs *FileServer) peerAddr(from string) string {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	return fs.addrs[from]
+}
+
+// peerName returns what peer is known as across reconnects, the address
+// it said hello with or else the address it is connected from
+func (fs *FileServer) peerName(peer p2p.Peer) string {
+	if addr := fs.peerAddr(peer.RemoteAddr().String()); addr != "" {
+		return addr
+	}
+	return peer.RemoteAddr().String()
+}
+
+func (fs *FileServer) redial(addr string) {
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-fs.quitch:
+			return
+		case <-time.After(backoff):
+		}
+
+		if err := fs.Transport.Dial(addr); err == nil {
+			return
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
 func (s *FileServer) stream(msg *Message) error {
 	peers := []io.Writer{}
-	for _, peer := range s.peers {
+	for _, peer := range s.peerList() {
 		peers = append(peers, peer)
 	}
 	log.Printf("broadcasting %+v", msg)
@@ -180,9 +600,8 @@ func (fs *FileServer) broadcast(msg *Message) error {
 	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
 		return err
 	}
-	for _, peer := range fs.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(msgBuf.Bytes()); err != nil {
+	for _, peer := range fs.peerList() {
+		if err := fs.write(peer, p2p.EncodeMessage(msgBuf.Bytes())); err != nil {
 			return err
 		}
 	}
@@ -190,6 +609,174 @@ func (fs *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// peerConn serializes the use of the connection to a peer
+type peerConn struct {
+	// request is held from sending a request until its reply was read, so
+	// every reply is read by the request it answers
+	request sync.Mutex
+	// write is held while writing to the connection, so messages, replies
+	// and uploads written at the same time don't interleave
+	write sync.Mutex
+}
+
+// conn returns the peerConn of peer
+func (fs *FileServer) conn(peer p2p.Peer) *peerConn {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	pc, ok := fs.conns[peer]
+	if !ok {
+		pc = &peerConn{}
+		fs.conns[peer] = pc
+	}
+	return pc
+}
+
+// write writes b to peer in one go
+func (fs *FileServer) write(peer p2p.Peer, b []byte) error {
+	pc := fs.conn(peer)
+	pc.write.Lock()
+	defer pc.write.Unlock()
+
+	return peer.Send(b)
+}
+
+// send writes msg to a single peer
+func (fs *FileServer) send(peer p2p.Peer, msg *Message) error {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return err
+	}
+	return fs.write(peer, p2p.EncodeMessage(msgBuf.Bytes()))
+}
+
+// request sends msg to peer and waits for the reply, which is read from
+// peer before calling done. Only one request to a peer is made at a time.
+func (fs *FileServer) request(peer p2p.Peer, msg *Message) (done func(), err error) {
+	pc := fs.conn(peer)
+	pc.request.Lock()
+	if err := fs.send(peer, msg); err != nil {
+		pc.request.Unlock()
+		return nil, err
+	}
+	if err := peer.WaitStream(); err != nil {
+		pc.request.Unlock()
+		return nil, err
+	}
+	return func() {
+		peer.CloseStream()
+		pc.request.Unlock()
+	}, nil
+}
+
+// sendFrame answers a request of peer with v as a stream holding a single
+// frame
+func (fs *FileServer) sendFrame(peer p2p.Peer, v any) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(p2p.IncomingStream)
+	if err := writeFrame(buf, v); err != nil {
+		return err
+	}
+	return fs.write(peer, buf.Bytes())
+}
+
+// sendFailure answers a request of peer that was sendFrame'd otherwise
+// with the error it failed with
+func (fs *FileServer) sendFailure(peer p2p.Peer, err error) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(p2p.IncomingStream)
+	binary.Write(buf, binary.LittleEndian, uint32(failedFrame))
+	if err := writeFrame(buf, err.Error()); err != nil {
+		return err
+	}
+	return fs.write(peer, buf.Bytes())
+}
+
+// failedFrame is the length a frame holding the error a request failed
+// with is announced with
+const failedFrame = math.MaxUint32
+
+// PeerError is the error a peer failed to answer a request with
+type PeerError struct {
+	Err string
+}
+
+func (e *PeerError) Error() string {
+	return "peer failed the request: " + e.Err
+}
+
+// readFailure reads the frame holding the error a peer failed a request
+// with
+func readFailure(r io.Reader) error {
+	var msg string
+	if _, err := readFrame(r, &msg); err != nil {
+		return err
+	}
+	return &PeerError{Err: msg}
+}
+
+// writeFrame gob encodes v into w prefixed with its length so it can be
+// read back from a connection without reading past it, a nil v is written
+// as an empty frame
+func writeFrame(w io.Writer, v any) error {
+	buf := new(bytes.Buffer)
+	if v != nil {
+		if err := gob.NewEncoder(buf).Encode(v); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readFrame reads a frame written by writeFrame into v, it reports false
+// when the frame was empty
+func readFrame(r io.Reader, v any) (bool, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return false, err
+	}
+	if size == 0 {
+		return false, nil
+	}
+	if size == failedFrame {
+		return false, readFailure(r)
+	}
+	if size > p2p.MaxMessageSize {
+		return false, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, p2p.MaxMessageSize)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false, err
+	}
+	return true, gob.NewDecoder(bytes.NewReader(buf)).Decode(v)
+}
+
+// peerList returns a snapshot of the currently connected peers
+func (fs *FileServer) peerList() []p2p.Peer {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// peer returns the connected peer with the remote address from
+func (fs *FileServer) peer(from string) (p2p.Peer, bool) {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	peer, ok := fs.peers[from]
+	return peer, ok
+}
+
 func (fs *FileServer) bootstrapNetwork() error {
 	for _, addr := range fs.BootstrapNodes {
 		if len(addr) == 0 {
@@ -237,41 +824,64 @@ func (s *FileServer) handleMessage(from string, m *Message) error {
 		return s.handleMesssageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageGetManifest:
+		return s.handleMessageGetManifest(from, v)
+	case MessageGetUploadOffset:
+		return s.handleMessageGetUploadOffset(from, v)
+	case MessageStatFile:
+		return s.handleMessageStatFile(from, v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from, v)
+	case MessageCapacity:
+		return s.handleMessageCapacity(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageRewrapFile:
+		return s.handleMessageRewrapFile(from, v)
 	}
 	return nil
 }
 
 func (fs *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
 
-	peer, ok := fs.peers[from]
+	peer, ok := fs.peer(from)
 	if !ok {
 		return fmt.Errorf("peer %s not in map", from)
 	}
 
+	buf := new(bytes.Buffer)
+	buf.WriteByte(p2p.IncomingStream)
+
 	if !fs.store.Has(msg.Key) {
-		peer.Send([]byte{p2p.IncomingStream})
-		binary.Write(peer, binary.LittleEndian, int64(0))
+		binary.Write(buf, binary.LittleEndian, int64(0))
+		fs.write(peer, buf.Bytes())
 		return fmt.Errorf("[%s] file not present on disk %s\n ", fs.Transport.Addr(), msg.Key)
 	}
 
 	log.Printf("[%s] serving file %s over the network\n", fs.Transport.Addr(), msg.Key)
 
-	filesize, r, err := fs.store.Read(msg.Key)
+	length, r, err := fs.store.ReadRange(msg.Key, msg.Offset, msg.Length)
 	if err != nil {
-		peer.Send([]byte{p2p.IncomingStream})
-		binary.Write(peer, binary.LittleEndian, int64(0))
+		binary.Write(buf, binary.LittleEndian, int64(-1))
+		writeFrame(buf, err.Error())
+		fs.write(peer, buf.Bytes())
 		return err
 	}
+	defer r.Close()
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
-	}
+	//first send incoming stream byte to the peer and then we can send the
+	//length of the range as an int64
+	binary.Write(buf, binary.LittleEndian, length)
 
-	//first send incoming stream byte to the peer and then we can send the file size
-	// as an int64
-	peer.Send([]byte{p2p.IncomingStream})
+	pc := fs.conn(peer)
+	pc.write.Lock()
+	defer pc.write.Unlock()
 
-	binary.Write(peer, binary.LittleEndian, filesize)
+	if err := peer.Send(buf.Bytes()); err != nil {
+		return err
+	}
 	n, err := io.Copy(peer, r)
 	if err != nil {
 		return err
@@ -282,23 +892,129 @@ func (fs *FileServer) handleMessageGetFile(from string, msg MessageGetFile) erro
 }
 
 func (fs *FileServer) handleMesssageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := fs.peers[from]
+	peer, ok := fs.peer(from)
 	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in peer list", from)
+		return fmt.Errorf("peer %s not in map", from)
 	}
 
-	n, err := fs.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	if msg.Size < 0 || msg.Offset < 0 || msg.Offset > msg.Size {
+		//there is no telling how much of the upload follows to skip it
+		peer.Close()
+		return fmt.Errorf("upload of %s from %d of %d bytes", msg.Key, msg.Offset, msg.Size)
+	}
+	if err := peer.WaitUpload(); err != nil {
+		return err
+	}
+	defer peer.CloseStream()
+
+	n, err := fs.receiveUpload(peer, msg)
+
+	//the uploader waits to learn whether the upload made it
+	result := &uploadResult{}
+	var quota *QuotaError
+	if errors.As(err, &quota) {
+		result.Err = quota
+	} else if err != nil {
+		result.Failed = err.Error()
+	}
+	if werr := fs.sendFrame(peer, result); werr != nil {
+		return werr
+	}
 	if err != nil {
 		return err
 	}
 
+	fs.readvertise()
 	log.Printf("%s written %d bytes to disk\n", fs.Transport.Addr(), n)
-
-	peer.CloseStream()
 	return nil
 }
 
+// receiveUpload stages the stream of the upload described by msg and
+// publishes it once it is complete
+func (fs *FileServer) receiveUpload(peer p2p.Peer, msg MessageStoreFile) (int64, error) {
+	r := io.LimitReader(peer, msg.Size-msg.Offset)
+
+	sf, err := fs.store.Stage(msg.Key, msg.ID, msg.Size)
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return 0, err
+	}
+	//closing it again once it was published or discarded does no harm
+	defer sf.Close()
+
+	n, err := sf.Append(r, msg.Offset)
+	if err != nil {
+		//whatever was received is kept in staging for the uploader to resume
+		io.Copy(io.Discard, r)
+		return 0, err
+	}
+
+	if !sf.Complete() {
+		return 0, fmt.Errorf("[%s] upload of %s stopped at %d of %d bytes", fs.Transport.Addr(), msg.Key, sf.Offset, msg.Size)
+	}
+	publish := sf.Publish
+	if isWireKey(msg.Key) && msg.Checksum != nil && sf.Convergent() {
+		//replicas of the same file from other owners are identical
+		publish = sf.PublishShared
+	}
+	var quota *QuotaError
+	if err := publish(msg.Checksum, msg.Meta); errors.As(err, &quota) {
+		//the upload will not fit when it is resumed either
+		sf.Discard()
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// requestStat asks peer for the metadata of key, nil is returned when the
+// peer does not have it
+func (fs *FileServer) requestStat(peer p2p.Peer, key string) (*Metadata, error) {
+	msg := Message{
+		Payload: MessageStatFile{
+			Key: key,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	meta := &Metadata{}
+	if ok, err := readFrame(peer, meta); !ok || err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (fs *FileServer) handleMessageStatFile(from string, msg MessageStatFile) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	meta, err := fs.store.Stat(msg.Key)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs.sendFrame(peer, nil)
+	}
+	if err != nil {
+		fs.sendFailure(peer, err)
+		return err
+	}
+	return fs.sendFrame(peer, meta)
+}
+
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetManifest{})
+	gob.Register(MessageGetUploadOffset{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageCapacity{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageHello{})
+	gob.Register(MessageRewrapFile{})
 }
@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dfs/client"
+	"dfs/p2p"
+	"dfs/seal"
+)
+
+func TestMain(m *testing.M) {
+	// makeServer takes the master key of the keyring from the environment
+	if os.Getenv(envMasterKey) == "" && os.Getenv(envPassphrase) == "" {
+		os.Setenv(envMasterKey, hex.EncodeToString(newEncryptionKey()))
+	}
+	os.Exit(m.Run())
+}
+
+func TestGetFromReplicas(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7001", root)
+	s2 := makeServer(":7002", root, ":7001")
+	s3 := makeServer(":7003", root, ":7001", ":7002")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	key := "replicated"
+	data := make([]byte, 3*pieceSize+123)
+	rand.Read(data)
+
+	if err := s3.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s3.store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("got %d bytes back, want %d", len(b), len(data))
+	}
+	if s3.store.Has(key) || !s3.cache.has(key) {
+		t.Errorf("a fetched file should be cached and not stored")
+	}
+
+	if err := s3.cache.remove(key); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s3.GetRange(key, pieceSize+10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data[pieceSize+10:pieceSize+110]) {
+		t.Errorf("range read over the network returned the wrong bytes")
+	}
+	if s3.store.Has(key) {
+		t.Errorf("a range read should not store the file locally")
+	}
+
+	// replicas that lost their final segment still open, the size of the
+	// object tells that the range came up short
+	wire := s3.wireKey(key)
+	for _, s := range []*FileServer{s1, s2} {
+		name := s.store.name(wire)
+		_, r, err := s.store.Backend.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if _, err := s.store.Backend.Put(name, bytes.NewReader(b[:len(b)-123-seal.TagSize])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var corrupt *CorruptionError
+	if _, err := s3.GetRange(key, 2*pieceSize, 0); !errors.As(err, &corrupt) || corrupt.Missing != 123 {
+		t.Errorf("a range of truncated replicas gave %v", err)
+	}
+
+	if _, err := s3.Get("not-stored-anywhere"); err == nil {
+		t.Errorf("expected an error for a key no peer has")
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7011", root)
+	s2 := makeServer(":7012", root, ":7011")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	key := "resumed"
+	data := make([]byte, 2*pieceSize+7)
+	rand.Read(data)
+	if _, err := s2.store.Write(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := s2.newUpload(key, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := parseEncHeader(up.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, err := hdr.dataKey(s2.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	er, err := newEncryptReader(encKey, hdr, bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, up.Header...), sealed...)
+	if int64(len(want)) != up.Size {
+		t.Errorf("have size %d want %d", up.Size, len(want))
+	}
+
+	// s1 already received the start of the upload before the connection
+	// dropped, peers only know the hashed key
+	replica := up.Replica.Key
+	if replica == key || replica != s2.wireKey(key) {
+		t.Errorf("the upload should carry the hashed key, have %s", replica)
+	}
+	sf, err := s1.store.Stage(replica, up.id(), up.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.Append(bytes.NewReader(want[:100]), 0); err != nil {
+		t.Fatal(err)
+	}
+	sf.Close()
+
+	peer := s2.peerList()[0]
+	offset, err := s2.requestUploadOffset(peer, up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 100 {
+		t.Errorf("have offset %d want %d", offset, 100)
+	}
+
+	if err := s2.push(peer, up); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	_, r, err := s1.store.Read(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, want) {
+		t.Errorf("resumed upload stored %d bytes that do not match", len(b))
+	}
+	if s1.store.Has(key) {
+		t.Errorf("the peer should not know the key")
+	}
+
+	// an upload left pending for a peer is pushed to that peer only
+	s3 := makeServer(":7013", root, ":7012")
+	go s3.Start()
+	defer s3.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	var peer3 p2p.Peer
+	for _, p := range s2.peerList() {
+		if !p.Outbound() {
+			peer3 = p
+		}
+	}
+	if peer3 == nil {
+		t.Fatal("s3 did not connect to s2")
+	}
+	s2.pendingLock.Lock()
+	s2.pending[peer.RemoteAddr().String()] = map[string]*upload{key: up}
+	s2.pending[peer3.RemoteAddr().String()] = map[string]*upload{key: up}
+	s2.pendingLock.Unlock()
+	s2.resumeUploads(peer3)
+	time.Sleep(100 * time.Millisecond)
+
+	if !s3.store.Has(replica) {
+		t.Errorf("expected the pending upload to be resumed on the reconnected peer")
+	}
+	s2.pendingLock.Lock()
+	_, done := s2.pending[peer3.RemoteAddr().String()]
+	_, left := s2.pending[peer.RemoteAddr().String()][key]
+	s2.pendingLock.Unlock()
+	if done || !left {
+		t.Errorf("resuming on one peer should only clear that peer's upload")
+	}
+}
+
+func TestScrubHealsCorruptObjects(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7021", root)
+	s2 := makeServer(":7022", root, ":7021")
+	s3 := makeServer(":7023", root, ":7021", ":7022")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	key := "rotting"
+	data := make([]byte, pieceSize+99)
+	rand.Read(data)
+	if err := s3.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	corrupt := func(s *FileServer, key string) {
+		path := s.store.Root + string(os.PathSeparator) + s.store.PathTransformFunc(key).FilePath()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)/2] ^= 0xff
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// s2 holds an encrypted replica under the hashed key, s3 the plain file
+	// it wrote itself
+	held := map[*FileServer]string{s2: s3.wireKey(key), s3: key}
+	for _, s := range []*FileServer{s2, s3} {
+		corrupt(s, held[s])
+		if err := s.Scrub(); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := s.Stats().Scrub
+		if stats.Corrupt != 1 || stats.Healed != 1 || len(stats.Findings) != 1 {
+			t.Errorf("[%s] unexpected scrub stats %+v", s.Transport.Addr(), stats)
+		}
+
+		if _, err := s.store.verify(held[s], io.Discard); err != nil {
+			t.Errorf("[%s] object still corrupt after scrub: %s", s.Transport.Addr(), err)
+		}
+
+		quarantined, _ := os.ReadDir(s.store.Root + string(os.PathSeparator) + quarantineDir)
+		if len(quarantined) != 2 {
+			t.Errorf("[%s] expected the object and its record in quarantine, found %d files", s.Transport.Addr(), len(quarantined))
+		}
+	}
+
+	r, err := s3.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, data) {
+		t.Errorf("healed object does not match what was stored")
+	}
+}
+
+func TestStatReplicatesMetadata(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7031", root)
+	s2 := makeServer(":7032", root, ":7031")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	key := "described"
+	meta := Metadata{
+		Key:         key,
+		ContentType: "image/png",
+		Tags:        map[string]string{"camera": "pinhole"},
+	}
+	if err := s2.StoreWithMetadata(meta, bytes.NewReader([]byte("not really a png"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	local, err := s2.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer keeps the metadata sealed under the hashed key
+	if s1.store.Has(key) {
+		t.Errorf("the peer should not know the key")
+	}
+	replica, err := s1.store.Stat(s2.wireKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Owner != ":7032" || replica.Tags != nil || replica.ContentType == "image/png" || replica.Sealed == nil {
+		t.Errorf("metadata was replicated in the clear: %+v", replica)
+	}
+	if bytes.Contains(replica.Sealed, []byte(key)) || bytes.Contains(replica.Sealed, []byte("pinhole")) {
+		t.Errorf("the sealed metadata holds the key or the tags")
+	}
+	opened, err := s2.openMeta(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Key != key || opened.Tags["camera"] != "pinhole" || opened.Size != local.Size || !opened.Created.Equal(local.Created) {
+		t.Errorf("metadata was not replicated: %+v", opened)
+	}
+
+	if err := s2.store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := s2.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Tags["camera"] != "pinhole" || remote.Size != local.Size {
+		t.Errorf("unexpected metadata from peer %+v", remote)
+	}
+
+	if _, err := s2.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := s2.cache.store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.ContentType != "image/png" || !fetched.Created.Equal(local.Created) {
+		t.Errorf("metadata was lost fetching the object back: %+v", fetched)
+	}
+}
+
+func TestListMergesPeers(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7041", root)
+	s2 := makeServer(":7042", root, ":7041")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// written straight to the local stores so each node knows different keys
+	s1.store.Write("docs/a", bytes.NewReader([]byte("a")))
+	s1.store.Write("docs/shared", bytes.NewReader([]byte("s")))
+	s2.store.Write("docs/b", bytes.NewReader([]byte("b")))
+	s2.store.Write("docs/shared", bytes.NewReader([]byte("s")))
+	s2.store.Write("other", bytes.NewReader([]byte("o")))
+
+	keys, err := s1.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"docs/a", "docs/b", "docs/shared"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("have %v want %v", keys, want)
+	}
+
+	// an object left only as replicas is listed by its owner alone
+	if err := s2.Store("docs/replicated", bytes.NewReader([]byte("r"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.store.Delete("docs/replicated"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s2.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"docs/a", "docs/b", "docs/replicated", "docs/shared"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("have %v want %v", keys, want)
+	}
+	if keys, _ := s1.List("docs/"); slices.Contains(keys, "docs/replicated") {
+		t.Errorf("a peer listed the key of a replica it holds: %v", keys)
+	}
+}
+
+func TestQuotaPlacement(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7051", root)
+	s2 := makeServer(":7052", root, ":7051")
+	s3 := makeServer(":7053", root, ":7051", ":7052")
+	s1.store.MaxBytes = 1000
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	big := make([]byte, 2000)
+	rand.Read(big)
+	if err := s3.Store("big", bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if s1.store.Has(s3.wireKey("big")) {
+		t.Errorf("s1 should have rejected an object past its quota")
+	}
+	if !s2.store.Has(s3.wireKey("big")) {
+		t.Errorf("s2 should hold a replica")
+	}
+	s3.pendingLock.Lock()
+	pending := 0
+	for _, uploads := range s3.pending {
+		pending += len(uploads)
+	}
+	s3.pendingLock.Unlock()
+	if pending != 0 {
+		t.Errorf("a rejected upload should not be retried, have %d pending", pending)
+	}
+
+	// s1 advertised its limit, so it is not even asked for the next object
+	if peers := s3.placement(int64(len(big))); len(peers) != 1 || !strings.HasSuffix(peers[0].RemoteAddr().String(), ":7052") {
+		t.Errorf("expected only s2 to be picked, have %v", peers)
+	}
+
+	if err := s1.Store("local", bytes.NewReader(big)); err == nil {
+		t.Errorf("expected a local write past the quota to fail")
+	}
+
+	// s1 filling up is advertised without waiting for a reconnect
+	if peers := s3.placement(10); len(peers) != 2 {
+		t.Errorf("expected both peers to be picked, have %v", peers)
+	}
+	if err := s1.Store("almost full", bytes.NewReader(big[:960])); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if peers := s3.placement(10); len(peers) != 1 || !strings.HasSuffix(peers[0].RemoteAddr().String(), ":7052") {
+		t.Errorf("expected s1 to be skipped once nearly full, have %v", peers)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+	})
+	c := newCache(store, 25)
+
+	put := func(key string) {
+		if _, err := store.Write(key, bytes.NewReader(make([]byte, 10))); err != nil {
+			t.Fatal(err)
+		}
+		c.admit(key)
+	}
+	put("a")
+	put("b")
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	put("c")
+
+	if c.has("b") || store.Has("b") {
+		t.Errorf("expected the least recently used object to be evicted")
+	}
+	if !c.has("a") || !c.has("c") {
+		t.Errorf("expected a and c to stay cached")
+	}
+
+	// an object larger than the whole cache is kept until the next one
+	if _, err := store.Write("huge", bytes.NewReader(make([]byte, 100))); err != nil {
+		t.Fatal(err)
+	}
+	c.admit("huge")
+	if !c.has("huge") || c.has("a") || c.has("c") {
+		t.Errorf("expected only the huge object to be left")
+	}
+
+	// after a restart objects are ranked by their use on this node, not by
+	// when their owner wrote them
+	opts := StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+	}
+	store = NewStore(opts)
+	c = newCache(store, 25)
+	for _, meta := range []Metadata{
+		{Key: "written late", Modified: time.Now().Add(time.Hour)},
+		{Key: "written early", Modified: time.Now().Add(-time.Hour)},
+	} {
+		if _, err := store.WriteWithMetadata(meta, bytes.NewReader(make([]byte, 10))); err != nil {
+			t.Fatal(err)
+		}
+		c.admit(meta.Key)
+	}
+	store = NewStore(opts)
+	c = newCache(store, 25)
+	put("d")
+	if c.has("written late") || !c.has("written early") {
+		t.Errorf("expected the object fetched first to be evicted")
+	}
+}
+
+func TestExpiryReapsClusterWide(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7061", root)
+	s2 := makeServer(":7062", root, ":7061")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s2.StoreWithTTL("artifact", 200*time.Millisecond, bytes.NewReader([]byte("build output"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Store("release", bytes.NewReader([]byte("keep me"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	replica, err := s1.store.Stat(s2.wireKey("artifact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Expires.IsZero() {
+		t.Errorf("the expiry should be replicated with the object")
+	}
+	if n := s2.Reap(); n != 0 {
+		t.Errorf("reaped %d objects before they expired", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := s2.Reap(); n != 1 {
+		t.Errorf("expected one object to be reaped, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if s1.store.Has(s2.wireKey("artifact")) || s2.store.Has("artifact") {
+		t.Errorf("the expired object should be gone from every node")
+	}
+	if !s1.store.Has(s2.wireKey("release")) || !s2.store.Has("release") {
+		t.Errorf("objects without an expiry should stay")
+	}
+
+	// only the owner of a replica can delete it
+	msg := Message{Payload: MessageDeleteFile{Key: "release"}}
+	for _, peer := range s1.peerList() {
+		if err := s1.send(peer, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !s2.store.Has("release") {
+		t.Errorf("a peer should not be able to delete an object it does not own")
+	}
+
+	if err := s2.Delete("release"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s1.store.Has(s2.wireKey("release")) {
+		t.Errorf("a network delete should reach every peer")
+	}
+}
+
+func TestStorageKeyEncryptsEveryCopy(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7071", root)
+	s2 := makeServer(":7072", root, ":7071")
+	for _, s := range []*FileServer{s1, s2} {
+		s.store.Keys = s.keys
+		s.cache.store.Keys = s.keys
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := bytes.Repeat([]byte("confidential "), 1000)
+	if err := s2.Store("secret", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !s1.store.Has(s2.wireKey("secret")) {
+		t.Fatal("s1 should hold a replica")
+	}
+
+	if err := s2.store.Delete("secret"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Get("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("fetching the object back gave %d bytes (%v)", len(b), err)
+	}
+	if !s2.cache.has("secret") {
+		t.Errorf("the fetched object should be cached")
+	}
+
+	// neither the replica nor the cached copy is kept in the clear
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(b, []byte("confidential")) {
+			t.Errorf("%s holds the plaintext", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7081", root)
+	s2 := makeServer(":7082", root, ":7081")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("pushed before the restart")
+	if err := s2.Store("durable", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the replica s1 holds can be opened by s2 after it comes back with
+	// the keyring from its storage root
+	restarted, err := NewFileServer(&s2.FileServerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key := s2.keys.Current()
+	if k, err := restarted.keys.Key(id); err != nil || !bytes.Equal(k, key) {
+		t.Fatalf("the restarted node came back with different keys")
+	}
+	if restarted.wireKey("durable") != s2.wireKey("durable") {
+		t.Fatalf("the restarted node hashes keys differently")
+	}
+
+	_, r, err := s1.store.Read(s2.wireKey("durable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(restarted.keys, r, out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("decrypting the replica after a restart gave %q (%v)", out, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7091", root)
+	s2 := makeServer(":7092", root, ":7091")
+	for _, s := range []*FileServer{s1, s2} {
+		s.store.Keys = s.keys
+		s.cache.store.Keys = s.keys
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("encrypted under every key")
+	if err := s2.Store("rotated", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Store("elsewhere", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, r, err := s1.store.Read(s2.wireKey("rotated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := io.ReadAll(r)
+
+	old, _ := s2.keys.Current()
+	// a peer that is not connected while the keys are rotated keeps the
+	// replica it holds under the old key
+	meta, _ := s2.store.Stat("elsewhere")
+	if err := s2.store.setReplica("elsewhere", ":7099", replica{Version: meta.Version, KeyID: old}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s2.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.RetireKey(old); err == nil {
+		t.Errorf("a key still in use should not be retired")
+	}
+
+	status := s2.Rekey()
+	if status.Current != id || len(status.Retirable) != 0 || status.Pending[old] != 1 {
+		t.Fatalf("have status %+v after re-encrypting with a peer missing", status)
+	}
+	if err := s2.Delete("elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if status := s2.KeyStatus(); !slices.Equal(status.Retirable, []uint32{old}) {
+		t.Fatalf("have status %+v once nothing depends on the old key", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the data key of the replica on s1 was wrapped with the new key, its
+	// segments stayed as they were
+	_, r, err = s1.store.Read(s2.wireKey("rotated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, _ := io.ReadAll(r)
+	hdr, err := parseEncHeader(replica)
+	if err != nil || hdr.keyID() != id {
+		t.Errorf("the replica should be encrypted with key %d (%v)", id, err)
+	}
+	if err == nil && !bytes.Equal(replica[hdr.size():], before[hdr.size():]) {
+		t.Errorf("the segments of the replica should not change")
+	}
+
+	if err := s2.RetireKey(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.RetireKey(id); err == nil {
+		t.Errorf("the current key should not be retired")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(s2.keys, bytes.NewReader(replica), out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("decrypting the replica after retiring the old key gave %q (%v)", out, err)
+	}
+	if err := s2.store.Delete("rotated"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s2.Get("rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+		t.Errorf("fetching after the rotation gave %q", b)
+	}
+}
+
+func TestConvergentReplicasAreIdentical(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7101", root)
+	s2 := makeServer(":7102", root, ":7101")
+	for _, s := range []*FileServer{s1, s2} {
+		s.keys.cluster = []byte("shared by the cluster")
+		s.Convergent = true
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("the same content written on both nodes")
+	if err := s1.Store("from s1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Store("from s2", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	_, r, err := s2.store.Read(s1.wireKey("from s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, _ := io.ReadAll(r)
+	_, r, err = s1.store.Read(s2.wireKey("from s2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, _ := io.ReadAll(r)
+	if len(r1) == 0 || !bytes.Equal(r1, r2) {
+		t.Errorf("the replicas of the same content differ")
+	}
+
+	// only the sealed metadata depends on the keyring, pushing again after
+	// a rotation stores the same bytes
+	old, _ := s1.keys.Current()
+	if _, err := s1.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if status := s1.Rekey(); !slices.Equal(status.Retirable, []uint32{old}) {
+		t.Errorf("have status %+v after re-encrypting", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, r, err = s2.store.Read(s1.wireKey("from s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, r1) {
+		t.Errorf("the replica changed with the key")
+	}
+	if err := s1.RetireKey(old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s1.store.Delete("from s1"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s1.Get("from s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+		t.Errorf("fetching the convergent replica gave %q", b)
+	}
+}
+
+func TestConvergentReplicasAreStoredOnce(t *testing.T) {
+	root := t.TempDir()
+
+	s3 := makeServer(":7133", root)
+	s1 := makeServer(":7131", root, ":7133")
+	s2 := makeServer(":7132", root, ":7133")
+	for _, s := range []*FileServer{s3, s1, s2} {
+		s.keys.cluster = []byte("shared by the cluster")
+		s.Convergent = true
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("the same content owned by two nodes")
+	if err := s1.Store("from s1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Store("from s2", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	meta1, err := s3.store.Stat(s1.wireKey("from s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta2, err := s3.store.Stat(s2.wireKey("from s2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := blobKey(meta1.Checksum)
+	if !bytes.Equal(meta1.Checksum, meta2.Checksum) || s3.store.index.shared(blob) != 2 {
+		t.Fatalf("the replicas are not stored once")
+	}
+	if n, _ := s3.store.index.usage(); n != meta1.Size {
+		t.Errorf("have %d bytes stored for replicas of %d bytes", n, meta1.Size)
+	}
+	keys, err := s3.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(keys, isBlobKey) {
+		t.Errorf("have blobs listed in %v", keys)
+	}
+
+	if err := s1.Delete("from s1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s3.store.Has(s1.wireKey("from s1")) {
+		t.Errorf("the deleted replica is still there")
+	}
+	_, r, err := s3.store.Read(s2.wireKey("from s2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); int64(len(b)) != meta2.Size {
+		t.Errorf("have %d bytes of the remaining replica, want %d", len(b), meta2.Size)
+	}
+
+	if err := s2.Delete("from s2"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s3.store.Has(blob) {
+		t.Errorf("the blob outlived its replicas")
+	}
+}
+
+func TestClientEncryptsBeforeTheNode(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7111", root)
+	s2 := makeServer(":7112", root, ":7111")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	c, err := client.New(s2, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("only the client reads this "), 1000)
+	if err := c.Put("myPrivateData", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the node the client talks to holds neither the plaintext nor the name
+	if s2.store.Has("myPrivateData") || !s2.store.Has(c.Key("myPrivateData")) {
+		t.Errorf("the node should only know the hashed name")
+	}
+	_, r, err := s2.store.Read(c.Key("myPrivateData"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); bytes.Contains(b, []byte("only the client")) {
+		t.Errorf("the node holds the plaintext")
+	}
+
+	// the object comes back from the replica once the node lost its copy
+	if err := s2.store.Delete(c.Key("myPrivateData")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = c.Get("myPrivateData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("reading through the client gave %d bytes (%v)", len(b), err)
+	}
+}
+
+func TestSignedObjects(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7121", root)
+	s2 := makeServer(":7122", root, ":7121")
+	s1.Sign = true
+	s1.TrustedKeys = []ed25519.PublicKey{s1.PublicKey()}
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("written by s1")
+	meta := Metadata{Key: "signed", Tags: map[string]string{"build": "42"}}
+	if err := s1.StoreWithMetadata(meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	local, err := s1.store.Stat("signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local.Signer, s1.PublicKey()) || local.Signature == nil {
+		t.Fatalf("the object was not signed: %+v", local)
+	}
+	if _, err := s1.Get("signed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature travels with the replica and still verifies once the
+	// object is fetched back into the cache
+	if err := s1.store.Delete("signed"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s1.GetRange("signed", 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data[3:8]) {
+		t.Errorf("a range of the signed replica gave %q", b)
+	}
+	r, err = s1.Get("signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+		t.Errorf("fetching the signed object gave %q", b)
+	}
+
+	// changing what the signature covers breaks it
+	s1.cache.store.index.update("signed", func(rec *indexRecord) bool {
+		rec.Meta.Tags["build"] = "43"
+		return true
+	})
+	if _, err := s1.Get("signed"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered metadata gave %v, want ErrBadSignature", err)
+	}
+
+	if _, err := s1.store.Write("unsigned", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Get("unsigned"); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("an unsigned object gave %v, want ErrUnsigned", err)
+	}
+	if err := s1.Store("resigned", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	s1.TrustedKeys = []ed25519.PublicKey{s2.PublicKey()}
+	if _, err := s1.Get("resigned"); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("an object of an untrusted writer gave %v, want ErrUntrustedSigner", err)
+	}
+	if _, err := s1.GetRange("resigned", 0, 4); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("a range of an object of an untrusted writer gave %v, want ErrUntrustedSigner", err)
+	}
+	if err := s1.store.Delete("resigned"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.GetRange("resigned", 0, 4); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("a range of a replica of an untrusted writer gave %v, want ErrUntrustedSigner", err)
+	}
+
+	// without trusted keys unsigned objects are read as before
+	if _, err := s2.store.Write("unsigned", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.Get("unsigned"); err != nil {
+		t.Errorf("reading an unsigned object without trusted keys: %v", err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	root := t.TempDir()
+
+	s1 := makeServer(":7141", root)
+	s2 := makeServer(":7142", root, ":7141")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// both nodes push to each other at the same time
+	data := make(map[string][]byte)
+	errc := make(chan error, 8)
+	for i, s := range []*FileServer{s1, s2, s1, s2, s1, s2, s1, s2} {
+		key := fmt.Sprintf("file %d", i)
+		data[key] = make([]byte, 100<<10+i)
+		rand.Read(data[key])
+		go func(s *FileServer, b []byte) {
+			errc <- s.Store(key, bytes.NewReader(b))
+		}(s, data[key])
+	}
+	for range data {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// with the local copies gone every Get and Stat asks the peer
+	for key := range data {
+		for _, s := range []*FileServer{s1, s2} {
+			s.store.Delete(key)
+		}
+	}
+	errc = make(chan error, 2*len(data))
+	for i, key := range slices.Sorted(maps.Keys(data)) {
+		s := []*FileServer{s1, s2}[i%2]
+		go func() {
+			r, err := s.Get(key)
+			if err != nil {
+				errc <- err
+				return
+			}
+			b, err := io.ReadAll(r)
+			if err == nil && !bytes.Equal(b, data[key]) {
+				err = fmt.Errorf("%s: have %d other bytes", key, len(b))
+			}
+			errc <- err
+		}()
+		go func() {
+			meta, err := s.Stat(key)
+			if err == nil && meta.Size != int64(len(data[key])) {
+				err = fmt.Errorf("%s: have the metadata of a file of %d bytes", key, meta.Size)
+			}
+			errc <- err
+		}()
+	}
+	for range 2 * len(data) {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
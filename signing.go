@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Objects can be signed by the node writing them. The signature covers the
+// key, the size, the content type, the tags, the expiry and the checksum of
+// the plaintext, it travels with the metadata and is checked on Get against
+// the trusted keys of the reading node. The checksum ties the signature to
+// the content, which the store verifies on every full read.
+
+var (
+	// ErrUnsigned is returned when reading an object without a signature
+	// from a node that only accepts objects signed by trusted keys
+	ErrUnsigned = errors.New("object is not signed")
+	// ErrBadSignature is returned when the signature of an object does not
+	// match its metadata
+	ErrBadSignature = errors.New("object signature does not verify")
+	// ErrUntrustedSigner is returned when an object is signed by a key that
+	// is not trusted
+	ErrUntrustedSigner = errors.New("object is signed by an untrusted key")
+)
+
+func newSigningKey() ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return priv
+}
+
+// signed returns the digest of the metadata the signature is made over
+func (m *Metadata) signed() []byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint64(len(b)))
+		h.Write(b)
+	}
+
+	field([]byte("dfs signed object v1"))
+	field([]byte(m.Key))
+	binary.Write(h, binary.BigEndian, m.Size)
+	field([]byte(m.ContentType))
+	tags := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		tags = append(tags, k)
+	}
+	slices.Sort(tags)
+	binary.Write(h, binary.BigEndian, uint64(len(tags)))
+	for _, k := range tags {
+		field([]byte(k))
+		field([]byte(m.Tags[k]))
+	}
+	var expires int64
+	if !m.Expires.IsZero() {
+		expires = m.Expires.UnixNano()
+	}
+	binary.Write(h, binary.BigEndian, expires)
+	field(m.Checksum)
+	return h.Sum(nil)
+}
+
+// sign signs the metadata with priv
+func (m *Metadata) sign(priv ed25519.PrivateKey) {
+	m.Signer = priv.Public().(ed25519.PublicKey)
+	m.Signature = ed25519.Sign(priv, m.signed())
+}
+
+// verifySignature checks the signature of the metadata, which has to be made
+// by one of trusted when any keys are trusted
+func (m *Metadata) verifySignature(trusted []ed25519.PublicKey) error {
+	if m.Signature == nil {
+		if len(trusted) > 0 {
+			return fmt.Errorf("%w: %s", ErrUnsigned, m.Key)
+		}
+		return nil
+	}
+	if len(m.Signer) != ed25519.PublicKeySize || !ed25519.Verify(m.Signer, m.signed(), m.Signature) {
+		return fmt.Errorf("%w: %s", ErrBadSignature, m.Key)
+	}
+	if len(trusted) > 0 && !slices.ContainsFunc(trusted, func(k ed25519.PublicKey) bool {
+		return bytes.Equal(k, m.Signer)
+	}) {
+		return fmt.Errorf("%w: %s signed by %x", ErrUntrustedSigner, m.Key, []byte(m.Signer))
+	}
+	return nil
+}
+
+// WriteSigned writes the object for meta.Key like WriteWithMetadata and
+// signs its metadata with priv
+func (s *Store) WriteSigned(meta Metadata, priv ed25519.PrivateKey, r io.Reader) (int64, error) {
+	return s.put(&meta, nil, r, priv)
+}
+
+// verifySigner checks the signature of the object for key in st against
+// the trusted keys
+func (fs *FileServer) verifySigner(st *Store, key string) error {
+	meta, err := st.Stat(key)
+	if err != nil {
+		return err
+	}
+	return meta.verifySignature(fs.TrustedKeys)
+}
+
+// PublicKey returns the key the objects written by this node are signed
+// with, for other nodes to trust
+func (fs *FileServer) PublicKey() ed25519.PublicKey {
+	return fs.keys.signingKey().Public().(ed25519.PublicKey)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// stagingDir is the folder inside the storage root holding transfers that
+// have not been fully received yet. Paths produced by the path transform
+// never start with a dot so it can not clash with stored files
+const stagingDir = ".staging"
+
+// Progress is the record kept next to a staged file, it describes how
+// much of the transfer has been received and verified so that an
+// interrupted transfer can pick up where it left off
+type Progress struct {
+	Key string
+	// ID identifies the content being transferred, a staged file is only
+	// resumed by a transfer with the same ID
+	ID   string
+	Size int64
+	// Offset is the number of contiguous bytes durably written from the
+	// start of the file, used by uploads which arrive in order
+	Offset int64
+	// Pieces marks the verified pieces, used by downloads which arrive in
+	// any order
+	Pieces []bool
+}
+
+// StagedFile is a partially received file in the staging area of a Store
+type StagedFile struct {
+	Progress
+
+	store *Store
+	path  string
+	file  *os.File
+}
+
+// Stage opens the staging file for key. When a previous transfer with the
+// same id and size was interrupted its progress is kept, otherwise the
+// staging file starts out empty.
+func (s *Store) Stage(key, id string, size int64) (*StagedFile, error) {
+	if size < 0 || size > maxFileSize {
+		return nil, fmt.Errorf("can't stage a file of %d bytes", size)
+	}
+	dir := s.Root + string(os.PathSeparator) + stagingDir
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	sf := &StagedFile{
+		store: s,
+		path:  s.stagingPath(key),
+	}
+
+	progress, err := readProgress(sf.path)
+	if err != nil {
+		return nil, err
+	}
+	sf.Progress = *progress
+
+	fresh := sf.Key != key || sf.ID != id || sf.Size != size
+	if fresh {
+		sf.Progress = Progress{
+			Key:    key,
+			ID:     id,
+			Size:   size,
+			Pieces: make([]bool, numPieces(size)),
+		}
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if fresh {
+		flag |= os.O_TRUNC
+	}
+	sf.file, err = os.OpenFile(sf.path+".part", flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return sf, nil
+}
+
+// StagedOffset returns how much of the transfer with the given id and size
+// has been staged for key. Unlike Stage it leaves the staging file alone,
+// a transfer with another id only replaces it once it starts sending.
+func (s *Store) StagedOffset(key, id string, size int64) (int64, error) {
+	progress, err := readProgress(s.stagingPath(key))
+	if err != nil {
+		return 0, err
+	}
+	if progress.Key != key || progress.ID != id || progress.Size != size {
+		return 0, nil
+	}
+	return progress.Offset, nil
+}
+
+// stagingPath returns the path the staging file for key and its progress
+// are kept at, without their extensions
+func (s *Store) stagingPath(key string) string {
+	return s.Root + string(os.PathSeparator) + stagingDir + string(os.PathSeparator) + s.PathTransformFunc(key).fileName
+}
+
+// readProgress reads the progress kept next to the staging file at path,
+// there being none is the same as an empty one
+func readProgress(path string) (*Progress, error) {
+	progress := &Progress{}
+	b, err := os.ReadFile(path + ".progress")
+	if err == nil {
+		err = json.Unmarshal(b, progress)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// WriteAt writes b into the staged file at offset
+func (sf *StagedFile) WriteAt(b []byte, offset int64) (int, error) {
+	return sf.file.WriteAt(b, offset)
+}
+
+// Append copies r into the staged file starting at offset, which can not
+// be past what has already been received. Progress is checkpointed after
+// every piece, so whatever made it to disk before r fails is kept.
+func (sf *StagedFile) Append(r io.Reader, offset int64) (int64, error) {
+	if offset > sf.Offset {
+		return 0, errors.New("staged file has a gap before the given offset")
+	}
+
+	var (
+		buf = make([]byte, pieceSize)
+		nw  int64
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := sf.file.WriteAt(buf[:n], offset+nw); werr != nil {
+				return nw, werr
+			}
+			nw += int64(n)
+			sf.Offset = offset + nw
+			if serr := sf.Checkpoint(); serr != nil {
+				return nw, serr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nw, nil
+		}
+		if err != nil {
+			return nw, err
+		}
+	}
+}
+
+// Checkpoint flushes the staged data to disk and then records the progress,
+// so the progress never claims more than is actually on disk
+func (sf *StagedFile) Checkpoint() error {
+	if sf.store.Durability != DurabilityNone {
+		if err := sf.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(sf.Progress)
+	if err != nil {
+		return err
+	}
+	tmp := sf.path + ".progress.tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sf.path+".progress")
+}
+
+// Complete reports whether every byte of the transfer has been received
+func (sf *StagedFile) Complete() bool {
+	if sf.Offset == sf.Size {
+		return true
+	}
+	for _, done := range sf.Pieces {
+		if !done {
+			return false
+		}
+	}
+	return len(sf.Pieces) > 0
+}
+
+// Checksum returns the sha256 checksum of what has been staged so far
+func (sf *StagedFile) Checksum() ([]byte, error) {
+	_, sum, err := hashFile(sf.path + ".part")
+	return sum, err
+}
+
+// Publish stores the staged file as the object for its key with meta as
+// its metadata, the object appears all at once or not at all. When want is
+// set the staged file has to match it, otherwise it is discarded and a
+// *CorruptionError is returned.
+func (sf *StagedFile) Publish(want []byte, meta Metadata) error {
+	if _, err := sf.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	meta.Key = sf.Key
+	_, err := sf.store.put(&meta, want, sf.file, nil)
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) {
+		sf.Discard()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	return sf.Discard()
+}
+
+// PublishDecrypt decrypts the staged file with the key of keys it names and
+// stores the result as the object for its key with meta as its metadata.
+// When want is set the decrypted file has to match it, otherwise a
+// *CorruptionError is returned.
+func (sf *StagedFile) PublishDecrypt(keys *Keyring, want []byte, meta Metadata) (int64, error) {
+	if _, err := sf.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r, _, err := NewDecryptingReader(keys, sf.file)
+	if err != nil {
+		return 0, err
+	}
+
+	meta.Key = sf.Key
+	n, err := sf.store.put(&meta, want, r, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, sf.Discard()
+}
+
+// Close releases the staged file but keeps it and its progress around so
+// the transfer can be resumed later
+func (sf *StagedFile) Close() error {
+	return sf.file.Close()
+}
+
+// Discard throws away the staged file and its progress
+func (sf *StagedFile) Discard() error {
+	sf.file.Close()
+	os.Remove(sf.path + ".progress")
+	if err := os.Remove(sf.path + ".part"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
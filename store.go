@@ -1,24 +1,62 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolder = "/home/happypotter/dfs"
 
 type PathTransformFunc func(string) PathKey
 
+// Durability controls how much effort a write makes to survive a crash
+type Durability int
+
+const (
+	// DurabilityFull syncs the file before it is renamed into place and
+	// the parent folder afterwards so the rename itself survives a crash
+	DurabilityFull Durability = iota
+	// DurabilityFile only syncs the file before it is renamed into place
+	DurabilityFile
+	// DurabilityNone leaves flushing to the operating system, a crash can
+	// lose recent writes but never leaves a half written file in place
+	DurabilityNone
+)
+
 type StoreOpts struct {
 	//Root is the folder path to the root on the disk containing all the
 	//folder structure
 	Root string
 	PathTransformFunc
+	//Durability of writes, defaults to DurabilityFull
+	Durability Durability
+	//Backend holds the bytes of the objects, defaults to a FSBackend
+	//over Root. The index and the staging area are always kept in Root.
+	Backend Backend
+	//MaxBytes and MaxObjects limit how much the store holds, writes that
+	//would exceed them fail with a *QuotaError. 0 is unlimited.
+	MaxBytes   int64
+	MaxObjects int
+	//Tiers are the storage tiers from hot to cold, new objects go to the
+	//first one. When set they take the place of Backend.
+	Tiers []Tier
+	//TierInterval is how often objects are considered for demotion,
+	//defaults to a minute
+	TierInterval time.Duration
+	//Keys encrypts every object written to the store at rest with its
+	//current key, reads decrypt them transparently. Without it objects are
+	//stored as written.
+	Keys *Keyring
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -55,6 +93,22 @@ func CASPathTransformFunc(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+
+	index *index
+
+	// quotaLock guards the bytes and objects reserved by writes in flight
+	quotaLock       sync.Mutex
+	reservedBytes   int64
+	reservedObjects int
+
+	// keys serializes changes to where the bytes of an object live
+	keys keyLocks
+
+	// blobLock serializes changes to which replicas share a blob
+	blobLock sync.Mutex
+
+	accessLock sync.Mutex
+	access     map[string]*access
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -65,84 +119,322 @@ func NewStore(opts StoreOpts) *Store {
 		opts.Root = defaultRootFolder
 	}
 
-	return &Store{
+	if len(opts.Tiers) == 0 {
+		opts.Tiers = []Tier{{Root: opts.Root, Backend: opts.Backend}}
+	}
+	opts.Tiers = append([]Tier(nil), opts.Tiers...)
+	for i := range opts.Tiers {
+		if opts.Tiers[i].Backend == nil {
+			opts.Tiers[i].Backend = NewFSBackend(opts.Tiers[i].Root, opts.Durability)
+		}
+	}
+	opts.Backend = opts.Tiers[0].Backend
+
+	s := &Store{
 		StoreOpts: opts,
+		access:    make(map[string]*access),
+		index:     newIndex(opts.Root+string(os.PathSeparator)+indexDir, opts.Durability),
 	}
+	if err := s.openIndex(); err != nil {
+		log.Printf("could not open the index in %s: %s", opts.Root, err)
+	}
+	return s
 }
 
 func (s *Store) Has(key string) bool {
-	PathKey := s.PathTransformFunc(key)
-	_, err := os.Stat(s.Root + string(os.PathSeparator) + PathKey.FilePath())
-	return !errors.Is(err, os.ErrNotExist)
+	return s.claim(key)
+}
+
+// name is what the object for key is called in the backend
+func (s *Store) name(key string) string {
+	return s.PathTransformFunc(key).FilePath()
 }
 
+// Clear deletes every object and the index. When the objects live in
+// the folder layout below Root the whole root is removed, apart from the
+// keyring which is still needed to read the replicas held by peers.
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	s.index.reset()
+
+	s.accessLock.Lock()
+	s.access = make(map[string]*access)
+	s.accessLock.Unlock()
+
+	for _, tier := range s.Tiers {
+		names, err := tier.Backend.List("")
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tier.Backend.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b, ok := s.Backend.(*FSBackend); ok && b.root == s.Root {
+		entries, err := os.ReadDir(s.Root)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name() == keyringDir {
+				continue
+			}
+			if err := os.RemoveAll(s.Root + string(os.PathSeparator) + e.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, dir := range []string{indexDir, stagingDir, quarantineDir} {
+		if err := os.RemoveAll(s.Root + string(os.PathSeparator) + dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Delete(key string) error {
-	pathKey := s.PathTransformFunc(key)
+	name := s.name(key)
 	defer func() {
-		log.Printf("deleted [%s] from disk", s.Root+string(os.PathSeparator)+pathKey.FilePath())
+		log.Printf("deleted [%s] from %s", name, s.Root)
 	}()
-	return os.RemoveAll(s.Root + string(os.PathSeparator) + pathKey.FilePath())
+	blob, err := s.remove(key, name)
+	if err != nil || blob == "" {
+		return err
+	}
+	return s.release(blob)
 }
 
-// todo : instread of copying directly to the reader we first copy this into
-// a bffer, maybe just return the file from readStream
+// remove deletes the object for key called name in the backend, a replica
+// sharing a blob only loses its record and the blob is returned
+func (s *Store) remove(key, name string) (string, error) {
+	unlock := s.keys.lock(key)
+	defer unlock()
+
+	b, _ := s.locate(key)
+	blob := s.index.blob(key)
+	if err := s.index.remove(key); err != nil {
+		return "", err
+	}
+	s.forget(key)
+	if blob != "" {
+		return blob, nil
+	}
+	return "", b.Delete(name)
+}
+
+// Read returns the object for key. The object is checked against its
+// recorded checksum while it is read, a mismatch shows up as a
+// *CorruptionError in place of io.EOF. Ranges read through ReadRange or
+// ReadAt are not checked.
 func (s *Store) Read(key string) (int64, io.Reader, error) {
-	return s.readStream(key)
+	return s.read(key, true)
 }
 
-func (s *Store) Write(key string, r io.Reader) (int64, error) {
-	return s.writeStream(key, r)
+// read is Read, a read that is not done on behalf of a client does not
+// count towards the tiering policy
+func (s *Store) read(key string, touch bool) (int64, io.Reader, error) {
+	size, r, err := s.open(key, touch)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	meta, ok := s.index.get(key)
+	if !ok || meta.Checksum == nil {
+		//objects written before checksums were recorded can't be checked
+		return size, r, nil
+	}
+
+	return size, newVerifyingReader(key, meta.Checksum, r), nil
+}
+
+// ReadRange returns a reader over length bytes of the file for key starting
+// at offset, together with the number of bytes it will yield. A length of 0
+// or one running past the end of the file reads up to the end of the file
+func (s *Store) ReadRange(key string, offset, length int64) (int64, io.ReadCloser, error) {
+	size, r, err := s.open(key, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if offset < 0 || offset > size {
+		r.Close()
+		return 0, nil, fmt.Errorf("offset %d out of range for %s of size %d", offset, key, size)
+	}
+	if length <= 0 || offset+length > size {
+		length = size - offset
+	}
+
+	if ra, ok := r.(io.ReaderAt); ok {
+		return length, &sectionReadCloser{
+			SectionReader: io.NewSectionReader(ra, offset, length),
+			Closer:        r,
+		}, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	return length, &limitReadCloser{
+		Reader: io.LimitReader(r, length),
+		Closer: r,
+	}, nil
 }
 
-func (s *Store) WriteDecrypt(enc []byte, key string, r io.Reader) (int64, error) {
+// ReadAt reads len(p) bytes of the file for key starting at offset into p
+func (s *Store) ReadAt(key string, p []byte, offset int64) (int, error) {
+	key = s.resolve(key)
+	b, _ := s.locate(key)
+	ra := backendReaderAt{b: b, name: s.name(key)}
+	if !s.index.sealed(key) {
+		return ra.ReadAt(p, offset)
+	}
+	if s.Keys == nil {
+		return 0, ErrNoKey
+	}
 
-	f, err := s.openFileForWriting(key)
+	stored, _ := s.index.stored(key)
+	sr, err := newSealedReaderAt(s.Keys, ra, stored)
 	if err != nil {
 		return 0, err
 	}
+	return sr.ReadAt(p, offset)
+}
 
-	n, err := copyDecrypt(enc, r, f)
-	return int64(n), err
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
 }
 
-func (s *Store) openFileForWriting(key string) (*os.File, error) {
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
 
-	pathKey := s.PathTransformFunc(key)
+func (s *Store) Write(key string, r io.Reader) (int64, error) {
+	return s.writeStream(key, r)
+}
 
-	if err := os.MkdirAll(s.Root+string(os.PathSeparator)+pathKey.pathName, os.ModePerm); err != nil {
-		return nil, err
+func (s *Store) WriteDecrypt(keys *Keyring, key string, r io.Reader) (int64, error) {
+	dr, _, err := NewDecryptingReader(keys, r)
+	if err != nil {
+		return 0, err
 	}
+	return s.put(&Metadata{Key: key}, nil, dr, nil)
+}
 
-	return os.Create(s.Root + string(os.PathSeparator) + pathKey.FilePath())
-
+// WriteWithMetadata writes the object for meta.Key together with meta,
+// the size, checksum and times are filled in by the store
+func (s *Store) WriteWithMetadata(meta Metadata, r io.Reader) (int64, error) {
+	return s.put(&meta, nil, r, nil)
 }
 
 func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
+	return s.WriteWithMetadata(Metadata{Key: key}, r)
+}
+
+// put stores everything read from r in the backend as the object described
+// by meta and records its metadata in the index. When want is set the
+// object is only stored if its checksum matches want. With a key the
+// object is encrypted on its way to the backend, the checksum and size in
+// meta are those of the plaintext. With priv the metadata is signed once
+// the checksum is known.
+func (s *Store) put(meta *Metadata, want []byte, r io.Reader, priv ed25519.PrivateKey) (int64, error) {
+	var (
+		h  = sha256.New()
+		cw = &countingWriter{w: h}
+		tr = io.TeeReader(r, cw)
+	)
+	if want != nil {
+		tr = newVerifyingReader(meta.Key, want, io.NopCloser(tr))
+	}
+	var (
+		sealed = s.Keys != nil
+		keyID  uint32
+	)
+	if sealed {
+		var err error
+		if tr, keyID, err = s.seal(tr); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := s.reserve(meta.Key, tr)
 	if err != nil {
 		return 0, err
 	}
+	defer res.release()
+
+	//a replica that shared a blob lets go of it once it has its own bytes
+	var shared string
+	defer func() {
+		if shared == "" {
+			return
+		}
+		if err := s.release(shared); err != nil {
+			log.Printf("removing %s: %s", shared, err)
+		}
+	}()
+
+	unlock := s.keys.lock(meta.Key)
+	defer unlock()
 
-	return io.Copy(f, r)
+	name := s.name(meta.Key)
+	if err := s.index.begin(meta.Key, name); err != nil {
+		return 0, err
+	}
+	n, err := s.Backend.Put(name, res)
+	if err != nil {
+		return 0, err
+	}
 
+	old, tier := s.locate(meta.Key)
+	s.prepare(meta, cw.n, h.Sum(nil), cw.head)
+	if priv != nil {
+		meta.sign(priv)
+	}
+	shared = s.index.blob(meta.Key)
+	if err := s.index.put(&indexRecord{Path: name, Size: n, Sealed: sealed, KeyID: keyID, Accessed: time.Now(), Meta: *meta}); err != nil {
+		return 0, err
+	}
+	//new objects go to the hottest tier, drop the copy in a colder one
+	if tier != 0 {
+		if err := old.Delete(name); err != nil {
+			log.Printf("removing %s from tier %d: %s", meta.Key, tier, err)
+		}
+	}
+	return cw.n, nil
 }
 
-func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
-	pathkey := s.PathTransformFunc(key)
+// countingWriter counts the bytes written through it and keeps the first
+// ones around for content type detection
+type countingWriter struct {
+	w    io.Writer
+	n    int64
+	head []byte
+}
 
-	file, err := os.Open(s.Root + string(os.PathSeparator) + pathkey.FilePath())
-	if err != nil {
-		return 0, nil, err
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if rest := 512 - len(c.head); rest > 0 {
+		c.head = append(c.head, p[:min(rest, n)]...)
 	}
+	c.n += int64(n)
+	return n, err
+}
 
-	fi, err := file.Stat()
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		return 0, nil, err
+		return err
 	}
+	defer d.Close()
 
-	return fi.Size(), file, nil
+	return d.Sync()
 }
@@ -2,8 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"dfs/seal"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -52,6 +62,986 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreReadRange(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	key := "myrangedpicture"
+	data := []byte("0123456789abcdef")
+	if _, err := s.Write(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 0, "0123456789abcdef"},
+		{4, 6, "456789"},
+		{10, 0, "abcdef"},
+		{12, 100, "cdef"},
+		{16, 0, ""},
+	}
+	for _, tt := range tests {
+		n, r, err := s.ReadRange(key, tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != tt.want || n != int64(len(tt.want)) {
+			t.Errorf("range (%d, %d) have %s (%d) want %s", tt.offset, tt.length, b, n, tt.want)
+		}
+	}
+
+	if _, _, err := s.ReadRange(key, 17, 0); err == nil {
+		t.Errorf("expected an error for an offset past the end")
+	}
+
+	buf := make([]byte, 3)
+	if _, err := s.ReadAt(key, buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "789" {
+		t.Errorf("have %s want %s", buf, "789")
+	}
+}
+
+func TestStageResume(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	key := "mystagedpicture"
+	data := []byte("some partially received jpg")
+
+	sf, err := s.Stage(key, "upload-1", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.Append(bytes.NewReader(data[:10]), 0); err != nil {
+		t.Fatal(err)
+	}
+	sf.Close()
+
+	if s.Has(key) {
+		t.Errorf("a staged file should not be visible before it is published")
+	}
+
+	// asking about another transfer leaves the staged one alone
+	if offset, err := s.StagedOffset(key, "upload-2", int64(len(data))); err != nil || offset != 0 {
+		t.Errorf("have offset %d, %v for another upload", offset, err)
+	}
+	if offset, err := s.StagedOffset(key, "upload-1", int64(len(data))); err != nil || offset != 10 {
+		t.Errorf("have offset %d, %v want %d", offset, err, 10)
+	}
+
+	sf, err = s.Stage(key, "upload-1", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.Offset != 10 {
+		t.Errorf("have offset %d want %d", sf.Offset, 10)
+	}
+	if _, err := sf.Append(bytes.NewReader(data[20:]), 20); err == nil {
+		t.Errorf("expected an error appending past the staged offset")
+	}
+	if _, err := sf.Append(bytes.NewReader(data[10:]), 10); err != nil {
+		t.Fatal(err)
+	}
+	if !sf.Complete() {
+		t.Errorf("expected the staged file to be complete")
+	}
+	if err := sf.Publish(nil, Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if string(b) != string(data) {
+		t.Errorf("have %s want %s", b, data)
+	}
+
+	sf, err = s.Stage(key, "upload-2", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Discard()
+	if sf.Offset != 0 {
+		t.Errorf("a different upload should not resume, have offset %d", sf.Offset)
+	}
+
+	for _, size := range []int64{-1, maxFileSize + 1} {
+		if _, err := s.Stage("bogus", "upload-3", size); err == nil {
+			t.Errorf("staged a file of %d bytes", size)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestStoreAtomicWrite(t *testing.T) {
+	for _, durability := range []Durability{DurabilityFull, DurabilityFile, DurabilityNone} {
+		s := NewStore(StoreOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+			Durability:        durability,
+		})
+
+		key := "myatomicpicture"
+		data := []byte("some jpg")
+		if _, err := s.Write(key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		partial := io.MultiReader(bytes.NewReader([]byte("half a")), failingReader{})
+		if _, err := s.Write(key, partial); err == nil {
+			t.Errorf("expected the failing write to return an error")
+		}
+
+		_, r, err := s.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != string(data) {
+			t.Errorf("a failed write replaced %s with %s", data, b)
+		}
+
+		pathKey := s.PathTransformFunc(key)
+		entries, err := os.ReadDir(s.Root + string(os.PathSeparator) + pathKey.pathName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("expected only the file to be left behind, found %d entries", len(entries))
+		}
+	}
+}
+
+func TestStoreChecksum(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	key := "mycheckedpicture"
+	data := []byte("some jpg that will rot")
+	if _, err := s.Write(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sha256.Sum256(data)
+	sum, err := s.Checksum(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum, want[:]) {
+		t.Errorf("have checksum %x want %x", sum, want)
+	}
+
+	//flip a bit on disk behind the store's back
+	path := s.Root + string(os.PathSeparator) + s.PathTransformFunc(key).FilePath()
+	b, _ := os.ReadFile(path)
+	b[3] ^= 0x1
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupt *CorruptionError
+	if _, err := io.ReadAll(r); !errors.As(err, &corrupt) {
+		t.Errorf("expected a corruption error, got %v", err)
+	}
+
+	sf, err := s.Stage("mystagedpicture", "upload-1", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.Append(bytes.NewReader(data), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Publish([]byte("not the checksum"), Metadata{}); !errors.As(err, &corrupt) {
+		t.Errorf("expected a corruption error, got %v", err)
+	}
+	if s.Has("mystagedpicture") {
+		t.Errorf("a staged file with the wrong checksum should not be published")
+	}
+}
+
+func TestStoreMetadata(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	key := "mytaggedpicture"
+	meta := Metadata{
+		Key:   key,
+		Owner: "me",
+		Tags:  map[string]string{"album": "holiday"},
+	}
+	if _, err := s.WriteWithMetadata(meta, bytes.NewReader([]byte("hello world"))); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Key != key || first.Size != 11 || first.Owner != "me" || first.Tags["album"] != "holiday" {
+		t.Errorf("unexpected metadata %+v", first)
+	}
+	if first.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("have content type %s", first.ContentType)
+	}
+	if first.Created.IsZero() || first.Modified.IsZero() {
+		t.Errorf("expected the times to be set")
+	}
+
+	if _, err := s.Write(key, bytes.NewReader([]byte("hello again world"))); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Created.Equal(first.Created) {
+		t.Errorf("overwriting should keep the creation time")
+	}
+	if second.Size != 17 || second.Modified.Before(first.Modified) {
+		t.Errorf("unexpected metadata after overwrite %+v", second)
+	}
+
+	if _, err := s.Stat("mymissingpicture"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{
+		Root:              root,
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	for _, key := range []string{"photos/b", "photos/a", "photos/c", "videos/a", "photo"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("photos/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, cursor, err := s.List("photos/", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "photos/a" || cursor != "photos/a" {
+		t.Errorf("first page have %v (%s)", keys, cursor)
+	}
+	keys, cursor, _ = s.List("photos/", cursor, 1)
+	if len(keys) != 1 || keys[0] != "photos/b" || cursor != "" {
+		t.Errorf("second page have %v (%s)", keys, cursor)
+	}
+
+	// a fresh store over the same root indexes what is already on disk
+	reopened := NewStore(StoreOpts{
+		Root:              root,
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	keys, _, _ = reopened.List("", "", 0)
+	want := []string{"photo", "photos/a", "photos/b", "videos/a"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("have %v want %v", keys, want)
+	}
+}
+
+func TestStoreIndex(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{
+		Root:              root,
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	s := NewStore(opts)
+
+	meta := Metadata{Key: "a", Tags: map[string]string{"kind": "note"}}
+	for i := 0; i < 2; i++ {
+		if _, err := s.WriteWithMetadata(meta, bytes.NewReader([]byte("hello"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Write("b", bytes.NewReader([]byte("world"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash between writing an object and recording it leaves an orphan
+	if err := s.index.begin("orphan", s.name("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Backend.Put(s.name("orphan"), bytes.NewReader([]byte("lost"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of an append leaves a torn record behind
+	logPath := root + string(os.PathSeparator) + indexDir + string(os.PathSeparator) + "log"
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{42, 0, 0, 0, 1, 2})
+	f.Close()
+
+	check := func(s *Store) {
+		t.Helper()
+		if s.Has("b") {
+			t.Errorf("expected b to be gone")
+		}
+		a, err := s.Stat("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Version != 2 || a.Size != 5 || a.Tags["kind"] != "note" {
+			t.Errorf("unexpected metadata %+v", a)
+		}
+		if !s.Has("c") {
+			t.Errorf("expected c to be indexed")
+		}
+		if _, err := s.Backend.Stat(s.name("orphan")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the orphan to be removed, have %v", err)
+		}
+	}
+
+	reopened := NewStore(opts)
+	if _, err := reopened.Write("c", bytes.NewReader([]byte("again"))); err != nil {
+		t.Fatal(err)
+	}
+	reopened = NewStore(opts)
+	check(reopened)
+
+	if err := reopened.CompactIndex(); err != nil {
+		t.Fatal(err)
+	}
+	check(NewStore(opts))
+}
+
+func TestStoreLegacyObjects(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{
+		Root:              root,
+		PathTransformFunc: CASPathTransformFunc,
+	}
+
+	// an object written before the index existed
+	backend := NewFSBackend(root, opts.Durability)
+	if _, err := backend.Put(CASPathTransformFunc("old").FilePath(), bytes.NewReader([]byte("from before"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(opts)
+	if keys, _, _ := s.List("", "", 0); len(keys) != 1 || !isLegacyKey(keys[0]) {
+		t.Fatalf("expected the object to be indexed under its name, have %v", keys)
+	}
+	if !s.Has("old") {
+		t.Fatal("expected the unindexed object to be found")
+	}
+	meta, err := s.Stat("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 11 || meta.Checksum != nil {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	_, r, err := s.Read("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "from before" {
+		t.Errorf("have %q", b)
+	}
+	if keys, _, _ := NewStore(opts).List("", "", 0); len(keys) != 1 || keys[0] != "old" {
+		t.Errorf("expected the object to be listed once found, have %v", keys)
+	}
+	if s.Has("missing") {
+		t.Errorf("expected no object for a key never written")
+	}
+
+	// only what the backend held when the index was built is taken in
+	if _, err := backend.Put(s.name("stray"), bytes.NewReader([]byte("stray"))); err != nil {
+		t.Fatal(err)
+	}
+	if NewStore(opts).Has("stray") {
+		t.Errorf("expected a file written past the store not to be indexed")
+	}
+}
+
+func TestStoreBackends(t *testing.T) {
+	pack, err := NewPackBackend(t.TempDir()+string(os.PathSeparator)+"objects.pack", DurabilityFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pack.Close()
+	segments, err := NewSegmentBackend(SegmentOpts{Dir: t.TempDir(), MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segments.Close()
+
+	backends := map[string]Backend{
+		"fs":       nil,
+		"memory":   NewMemoryBackend(),
+		"pack":     pack,
+		"segments": segments,
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore(StoreOpts{
+				Root:              t.TempDir(),
+				PathTransformFunc: CASPathTransformFunc,
+				Backend:           backend,
+			})
+
+			data := []byte("some jpg bytes")
+			for _, key := range []string{"a", "b"} {
+				if _, err := s.Write(key, bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Write("a", bytes.NewReader([]byte("replaced"))); err != nil {
+				t.Fatal(err)
+			}
+
+			_, r, err := s.Read("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil || string(b) != "replaced" {
+				t.Errorf("have %s (%v)", b, err)
+			}
+
+			n, rc, err := s.ReadRange("b", 5, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ = io.ReadAll(rc)
+			rc.Close()
+			if n != 3 || string(b) != "jpg" {
+				t.Errorf("have range %s of %d bytes", b, n)
+			}
+
+			if err := s.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Read("b"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected os.ErrNotExist, got %v", err)
+			}
+			names, err := s.Backend.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 || names[0] != s.PathTransformFunc("a").FilePath() {
+				t.Errorf("have names %v", names)
+			}
+
+			if err := s.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if names, _ := s.Backend.List(""); len(names) != 0 {
+				t.Errorf("expected clear to delete every object, have %v", names)
+			}
+		})
+	}
+}
+
+func TestPackBackendReopen(t *testing.T) {
+	path := t.TempDir() + string(os.PathSeparator) + "objects.pack"
+	b, err := NewPackBackend(path, DurabilityFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := b.Put(name, bytes.NewReader([]byte("data of "+name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	// a failed put leaves nothing behind
+	if _, err := b.Put("d", io.MultiReader(bytes.NewReader([]byte("half")), iotest.ErrReader(errors.New("gone")))); err == nil {
+		t.Errorf("expected the put to fail")
+	}
+	b.Close()
+
+	// a crash in the middle of a put leaves a pending record behind
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(packHeader("e", packPending))
+	f.Write([]byte("torn"))
+	f.Close()
+
+	b, err = NewPackBackend(path, DurabilityFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	names, _ := b.List("")
+	if strings.Join(names, ",") != "a,c" {
+		t.Errorf("have names %v", names)
+	}
+	p := make([]byte, 4)
+	if _, err := b.ReadAt("c", p, 5); err != nil || string(p) != "of c" {
+		t.Errorf("have %s (%v)", p, err)
+	}
+	if _, err := b.Put("f", bytes.NewReader([]byte("after"))); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := b.Stat("f"); err != nil || size != 5 {
+		t.Errorf("have size %d (%v)", size, err)
+	}
+}
+
+func TestSegmentBackend(t *testing.T) {
+	opts := SegmentOpts{
+		Dir:            t.TempDir(),
+		MaxSegmentSize: 256,
+	}
+	b, err := NewSegmentBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := func(name string, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s-%d;", name, round)), 8)
+	}
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, name := range names {
+		if _, err := b.Put(name, bytes.NewReader(data(name, 0))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a reader that is open while its segment is compacted keeps working
+	_, r, err := b.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names[:4] {
+		if _, err := b.Put(name, bytes.NewReader(data(name, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(old, data("a", 0)) {
+		t.Errorf("have %s (%v)", old, err)
+	}
+
+	var live int64
+	for _, name := range names {
+		if name == "e" {
+			continue
+		}
+		size, _ := b.Stat(name)
+		live += size + packHeaderSize + 1
+	}
+	segments, _ := filepath.Glob(opts.Dir + string(os.PathSeparator) + "*.seg")
+	var total int64
+	for _, path := range segments {
+		fi, _ := os.Stat(path)
+		total += fi.Size()
+	}
+	// only the active segment can hold garbage after a compaction
+	if total > live+opts.MaxSegmentSize {
+		t.Errorf("compaction left %d bytes for %d live bytes", total, live)
+	}
+	b.Close()
+
+	b, err = NewSegmentBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	have, _ := b.List("")
+	if strings.Join(have, ",") != "a,b,c,d,f" {
+		t.Errorf("have names %v", have)
+	}
+	for i, name := range []string{"a", "b", "c", "d", "f"} {
+		round := 1
+		if i == 4 {
+			round = 0
+		}
+		_, r, err := b.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(got, data(name, round)) {
+			t.Errorf("%s have %s", name, got)
+		}
+	}
+}
+
+func TestStoreQuota(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		MaxBytes:          10,
+		MaxObjects:        2,
+	})
+
+	if _, err := s.Write("a", bytes.NewReader([]byte("123456"))); err != nil {
+		t.Fatal(err)
+	}
+	var quota *QuotaError
+	if _, err := s.Write("b", bytes.NewReader([]byte("123456"))); !errors.As(err, &quota) {
+		t.Errorf("expected a quota error, got %v", err)
+	}
+	if s.Has("b") {
+		t.Errorf("a write past the quota should not be stored")
+	}
+	// replacing an object only needs room for the difference
+	if _, err := s.Write("a", bytes.NewReader([]byte("1234567890"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckQuota("b", 1); !errors.As(err, &quota) {
+		t.Errorf("expected a quota error, got %v", err)
+	}
+
+	if _, err := s.Write("a", bytes.NewReader([]byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("b", bytes.NewReader([]byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("c", bytes.NewReader([]byte("3"))); !errors.As(err, &quota) {
+		t.Errorf("expected the object limit to be enforced, got %v", err)
+	}
+
+	c := s.Capacity()
+	if c.Bytes != 2 || c.Objects != 2 {
+		t.Errorf("unexpected capacity %+v", c)
+	}
+}
+
+func TestStoreTiers(t *testing.T) {
+	opts := StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Tiers: []Tier{
+			{Root: t.TempDir(), DemoteAfter: time.Millisecond},
+			{Root: t.TempDir(), PromoteReads: 2},
+		},
+	}
+	s := NewStore(opts)
+	hot, cold := s.Tiers[0].Backend, s.Tiers[1].Backend
+	name := s.PathTransformFunc("a").FilePath()
+
+	if _, err := s.Write("a", bytes.NewReader([]byte("tiered"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if moved, err := s.Rebalance(); err != nil || moved != 1 {
+		t.Fatalf("moved %d (%v)", moved, err)
+	}
+	if _, err := hot.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the object to have left the hot tier, got %v", err)
+	}
+
+	// the index remembers the tier across restarts
+	s = NewStore(opts)
+	for i := 0; i < 2; i++ {
+		_, r, err := s.Read("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(r); string(b) != "tiered" {
+			t.Errorf("have %s", b)
+		}
+	}
+
+	// the second read promotes the object in the background
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := hot.Stat(name); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("object was not promoted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := cold.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the object to have left the cold tier, got %v", err)
+	}
+
+	// overwriting a cold object puts it back into the hot tier
+	if err := s.move("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("a", bytes.NewReader([]byte("rewritten"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cold.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the cold copy to be removed, got %v", err)
+	}
+	if size, err := hot.Stat(name); err != nil || size != 9 {
+		t.Errorf("have size %d (%v)", size, err)
+	}
+
+	// reads are kept track of while the policy needs them
+	if _, _, err := s.Read("a"); err != nil {
+		t.Fatal(err)
+	}
+	accessed := func() int {
+		s.accessLock.Lock()
+		defer s.accessLock.Unlock()
+		return len(s.access)
+	}
+	if n := accessed(); n != 1 {
+		t.Errorf("have %d objects with reads, want 1", n)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := accessed(); n != 0 {
+		t.Errorf("have %d objects with reads after deleting, want 0", n)
+	}
+}
+
+func TestStoreEncryptedAtRest(t *testing.T) {
+	data := make([]byte, 2*seal.SegmentSize+300)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	for name, backend := range map[string]func(t *testing.T) Backend{
+		"fs":     func(t *testing.T) Backend { return NewFSBackend(t.TempDir(), DurabilityNone) },
+		"memory": func(t *testing.T) Backend { return NewMemoryBackend() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := StoreOpts{
+				Root:              t.TempDir(),
+				PathTransformFunc: CASPathTransformFunc,
+				Backend:           backend(t),
+				Keys:              newKeyring(),
+			}
+			s := NewStore(opts)
+			objName := s.name("secret")
+
+			n, err := s.Write("secret", bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(data)) {
+				t.Errorf("have written %d want %d", n, len(data))
+			}
+
+			_, r, err := s.Backend.Get(objName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, _ := io.ReadAll(r)
+			r.Close()
+			hdr, err := parseEncHeader(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(raw)) != hdr.sealedSize(int64(len(data))) || bytes.Contains(raw, data[:64]) {
+				t.Errorf("the backend should only hold the encrypted object")
+			}
+
+			size, rr, err := s.Read("secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err := io.ReadAll(rr); err != nil || !bytes.Equal(b, data) || size != int64(len(data)) {
+				t.Errorf("reading gave %d bytes of size %d (%v)", len(b), size, err)
+			}
+
+			offset := int64(seal.SegmentSize - 10)
+			_, rc, err := s.ReadRange("secret", offset, seal.SegmentSize+20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			if !bytes.Equal(b, data[offset:offset+seal.SegmentSize+20]) {
+				t.Errorf("range across segments returned the wrong bytes")
+			}
+
+			p := make([]byte, 100)
+			if _, err := s.ReadAt("secret", p, int64(len(data))-100); err != nil || !bytes.Equal(p, data[len(data)-100:]) {
+				t.Errorf("ReadAt at the end returned the wrong bytes (%v)", err)
+			}
+
+			// a store without the keyring can't read it
+			opts.Keys = nil
+			if _, _, err := NewStore(opts).Read("secret"); !errors.Is(err, ErrNoKey) {
+				t.Errorf("have error %v want %v", err, ErrNoKey)
+			}
+
+			// tampering with the bytes at rest is caught on read
+			raw[len(raw)-5] ^= 1
+			if _, err := s.Backend.Put(objName, bytes.NewReader(raw)); err != nil {
+				t.Fatal(err)
+			}
+			_, rr, err = s.Read("secret")
+			if err == nil {
+				_, err = io.ReadAll(rr)
+			}
+			if !errors.Is(err, ErrCiphertext) {
+				t.Errorf("have error %v want %v", err, ErrCiphertext)
+			}
+		})
+	}
+}
+
+func TestStoreGrant(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+		Keys:              newKeyring(),
+	})
+	name := s.name("shared")
+	data := bytes.Repeat([]byte("per object key "), 10000)
+	if _, err := s.Write("shared", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	raw := func() ([]byte, *encHeader) {
+		_, r, err := s.Backend.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		b, _ := io.ReadAll(r)
+		hdr, err := parseEncHeader(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, hdr
+	}
+	before, hdr := raw()
+	segments := before[hdr.size():]
+
+	// someone holding only their own key reads the one object granted to them
+	other := &Keyring{current: 9, latest: 9, keys: map[uint32][]byte{9: newEncryptionKey()}}
+	if err := s.Grant("shared", 9, other.keys[9]); err != nil {
+		t.Fatal(err)
+	}
+	after, hdr := raw()
+	if !bytes.Equal(after[hdr.size():], segments) || len(hdr.Wraps) != 2 {
+		t.Errorf("granting should only add a wrap to the header")
+	}
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(other, bytes.NewReader(after), out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("the grantee could not decrypt the object (%v)", err)
+	}
+
+	// moving to a new key of the store keeps the grant
+	s.Keys.Rotate()
+	if err := s.reseal("shared"); err != nil {
+		t.Fatal(err)
+	}
+	after, hdr = raw()
+	if current, _ := s.Keys.Current(); hdr.keyID() != current || len(hdr.Wraps) != 2 {
+		t.Errorf("have wraps %v after rotating", hdr.Wraps)
+	}
+	if _, r, err := s.Read("shared"); err != nil {
+		t.Fatal(err)
+	} else if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("reading after rotating gave %d bytes (%v)", len(b), err)
+	}
+
+	if err := s.Revoke("shared", hdr.keyID()); err == nil {
+		t.Errorf("the key of the store should not be revoked")
+	}
+	if err := s.Revoke("shared", 9); err != nil {
+		t.Fatal(err)
+	}
+	after, _ = raw()
+	if _, err := copyDecrypt(other, bytes.NewReader(after), io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("have error %v want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestStoreSharedBlobs(t *testing.T) {
+	opts := StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Keys:              newKeyring(),
+	}
+	s := NewStore(opts)
+	data := []byte("the same replica for two owners")
+	sum := sha256.Sum256(data)
+	blob := blobKey(sum[:])
+
+	for _, key := range []string{"hmac:a", "hmac:b"} {
+		if _, err := s.putShared(&Metadata{Key: key}, sum[:], bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, r, err := s.Read(key); err != nil {
+			t.Fatal(err)
+		} else if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+			t.Errorf("reading %s gave %q", key, b)
+		}
+	}
+	stored, _ := s.index.stored(blob)
+	if n, count := s.index.usage(); n != stored || count != 3 || !s.index.sealed(blob) {
+		t.Errorf("have %d bytes in %d objects for a blob of %d bytes", n, count, stored)
+	}
+
+	// a replica getting bytes of its own lets go of the blob
+	if _, err := s.Write("hmac:a", bytes.NewReader([]byte("changed"))); err != nil {
+		t.Fatal(err)
+	}
+	if s.index.shared(blob) != 1 {
+		t.Errorf("have %d replicas sharing the blob, want 1", s.index.shared(blob))
+	}
+	if err := s.Delete("hmac:b"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(blob) {
+		t.Errorf("the blob outlived its replicas")
+	}
+
+	// a crash before the replica is recorded leaves a blob nobody shares
+	if _, err := s.put(&Metadata{Key: blob}, sum[:], bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if NewStore(opts).Has(blob) {
+		t.Errorf("the unshared blob was kept")
+	}
+}
+
 func TestDeleteKey(t *testing.T) {
 
 	s := newStore()
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTierInterval is how often objects are considered for demotion
+const defaultTierInterval = time.Minute
+
+// Tier is one level of a tiered store, objects move between neighbouring
+// tiers according to the policy of the tier they are in
+type Tier struct {
+	// Root is the folder holding the objects of the tier
+	Root string
+	// Backend holds the objects of the tier, defaults to a FSBackend over
+	// Root
+	Backend Backend
+	// DemoteAfter moves objects that have not been read for this long to
+	// the next colder tier, 0 never demotes
+	DemoteAfter time.Duration
+	// PromoteReads is the number of reads after which an object moves to
+	// the next hotter tier, 1 promotes on the first read and 0 never
+	// promotes
+	PromoteReads int
+}
+
+// access is what the tiering policy knows about the reads of an object
+type access struct {
+	last   time.Time
+	reads  int
+	moving bool
+}
+
+// keyLocks hands out a lock per key, taken by everything that changes
+// where the bytes of an object live
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// locate returns the backend holding the object for key and the index of
+// its tier, objects missing from the index are looked for in the hottest
+// tier
+func (s *Store) locate(key string) (Backend, int) {
+	tier, ok := s.index.tier(key)
+	if !ok || tier >= len(s.Tiers) {
+		tier = 0
+	}
+	return s.Tiers[tier].Backend, tier
+}
+
+// touch records a read of the object for key in tier and promotes it in
+// the background once the policy of the tier says so. Reads are only kept
+// track of while the policy of the tier makes use of them.
+func (s *Store) touch(key string, tier int) {
+	s.accessLock.Lock()
+	defer s.accessLock.Unlock()
+
+	var (
+		demotes  = tier < len(s.Tiers)-1 && s.Tiers[tier].DemoteAfter > 0
+		promotes = tier > 0 && s.Tiers[tier].PromoteReads > 0
+	)
+	if !demotes && !promotes {
+		delete(s.access, key)
+		return
+	}
+
+	a, ok := s.access[key]
+	if !ok {
+		a = &access{}
+		s.access[key] = a
+	}
+	a.last = time.Now()
+	a.reads++
+
+	promote := s.Tiers[tier].PromoteReads
+	if tier == 0 || promote == 0 || a.reads < promote || a.moving {
+		return
+	}
+	a.moving = true
+	go func() {
+		if err := s.move(key, tier-1); err != nil {
+			log.Printf("promoting %s: %s", key, err)
+		}
+		s.accessLock.Lock()
+		a.moving = false
+		s.accessLock.Unlock()
+	}()
+}
+
+// lastRead returns when the object described by meta was last read, an
+// object not read since the store was opened counts from its last write
+func (s *Store) lastRead(meta *Metadata) time.Time {
+	s.accessLock.Lock()
+	defer s.accessLock.Unlock()
+
+	if a, ok := s.access[meta.Key]; ok && a.last.After(meta.Modified) {
+		return a.last
+	}
+	return meta.Modified
+}
+
+func (s *Store) forget(key string) {
+	s.accessLock.Lock()
+	defer s.accessLock.Unlock()
+
+	delete(s.access, key)
+}
+
+// move moves the object for key to the given tier
+func (s *Store) move(key string, to int) error {
+	if to < 0 || to >= len(s.Tiers) {
+		return errors.New("no such tier")
+	}
+
+	unlock := s.keys.lock(key)
+	defer unlock()
+
+	from, ok := s.index.tier(key)
+	if !ok || from == to {
+		return nil
+	}
+
+	name := s.name(key)
+	src, dst := s.Tiers[from].Backend, s.Tiers[to].Backend
+
+	_, r, err := src.Get(name)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Put(name, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.index.setTier(key, to); err != nil {
+		dst.Delete(name)
+		return err
+	}
+	s.forget(key)
+
+	log.Printf("moved %s from tier %d to tier %d", key, from, to)
+	return src.Delete(name)
+}
+
+// Rebalance makes a single pass over the store, demoting every object
+// that has not been read for longer than its tier allows. It returns the
+// number of objects moved.
+func (s *Store) Rebalance() (int, error) {
+	var moved int
+	for _, rec := range s.index.records() {
+		//a replica sharing a blob moves with the blob
+		if rec.Blob != "" {
+			continue
+		}
+		meta := &rec.Meta
+		_, tier := s.locate(meta.Key)
+		after := s.Tiers[tier].DemoteAfter
+		if tier == len(s.Tiers)-1 || after == 0 || time.Since(s.lastRead(meta)) < after {
+			continue
+		}
+
+		if err := s.move(meta.Key, tier+1); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func (fs *FileServer) tierLoop() {
+	interval := fs.store.TierInterval
+	if interval <= 0 {
+		interval = defaultTierInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := fs.store.Rebalance(); err != nil {
+				log.Printf("[%s] rebalancing tiers: %s", fs.Transport.Addr(), err)
+			}
+		case <-fs.quitch:
+			return
+		}
+	}
+}
+
+// readTier opens the object for key wherever it lives, the read counts
+// towards the tiering policy when touch is set
+func (s *Store) readTier(key string, touch bool) (int64, io.ReadCloser, error) {
+	name := s.name(key)
+	b, tier := s.locate(key)
+	size, r, err := b.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		//a move can take the object away between locate and Get, by then
+		//the index points at the tier it went to
+		if moved, to := s.locate(key); to != tier {
+			tier = to
+			size, r, err = moved.Get(name)
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if touch && len(s.Tiers) > 1 {
+		s.touch(key, tier)
+	}
+	return size, r, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"dfs/p2p"
+	"dfs/seal"
+)
+
+// MessageGetUploadOffset asks a peer how much of the upload identified by
+// ID it has already received and verified
+type MessageGetUploadOffset struct {
+	Key  string
+	ID   string
+	Size int64
+}
+
+// uploadOffset is the reply to MessageGetUploadOffset. The peer reports
+// its capacity along with it and a *QuotaError when it has no room for
+// the upload.
+type uploadOffset struct {
+	Offset   int64
+	Capacity Capacity
+	Err      *QuotaError
+}
+
+// uploadResult is the reply of a peer once it received the stream of an
+// upload. Err is set when the peer ran out of room while writing it, any
+// other failure is described by Failed.
+type uploadResult struct {
+	Err    *QuotaError
+	Failed string
+}
+
+// upload is a file this node is pushing to its peers. Peers store the
+// encryption header followed by the sealed segments of the file, so with
+// the header kept around the bytes from any offset can be produced again
+// from the local copy.
+type upload struct {
+	Key    string
+	Header []byte
+	// KeyID is the key of the keyring the upload is encrypted with, in
+	// convergent mode the key its metadata is sealed with
+	KeyID uint32
+	Size  int64
+	// Checksum is the sha256 of what the peers end up storing
+	Checksum []byte
+	Meta     Metadata
+	// Replica is the metadata the peers keep, see sealMeta
+	Replica Metadata
+}
+
+// newUpload prepares pushing the locally stored file for key of the given
+// size, which is encrypted once up front to learn the checksum peers have
+// to end up with
+func (fs *FileServer) newUpload(key string, size int64) (*upload, error) {
+	hdr, dek, err := fs.uploadHeader(key)
+	if err != nil {
+		return nil, err
+	}
+	return fs.uploadWith(key, size, hdr, dek)
+}
+
+// uploadWith is newUpload for a file encrypted with the header hdr and the
+// data key dek it wraps
+func (fs *FileServer) uploadWith(key string, size int64, hdr *encHeader, dek []byte) (*upload, error) {
+	meta, err := fs.store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	replica, err := fs.sealMeta(*meta)
+	if err != nil {
+		return nil, err
+	}
+	keyID := hdr.keyID()
+	if keyID == convergentKeyID {
+		sealed, err := parseEncHeader(replica.Sealed)
+		if err != nil {
+			return nil, err
+		}
+		keyID = sealed.keyID()
+	}
+
+	_, r, err := fs.store.read(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	c, err := hdr.cipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	ew := c.NewWriter(h, hdr.bytes())
+	if _, err := io.Copy(ew, r); err != nil {
+		return nil, err
+	}
+	if err := ew.Close(); err != nil {
+		return nil, err
+	}
+
+	return &upload{
+		Key:      key,
+		Header:   hdr.bytes(),
+		KeyID:    keyID,
+		Size:     hdr.sealedSize(size),
+		Checksum: h.Sum(nil),
+		Meta:     *meta,
+		Replica:  replica,
+	}, nil
+}
+
+// uploadHeader returns the header and data key the file for key is pushed
+// with, in convergent mode they are derived from its content
+func (fs *FileServer) uploadHeader(key string) (*encHeader, []byte, error) {
+	if !fs.Convergent {
+		return newEncHeader(fs.keys)
+	}
+
+	_, r, err := fs.store.read(key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	return newConvergentHeader(fs.keys, r)
+}
+
+func (u *upload) id() string {
+	return hex.EncodeToString(u.Header)
+}
+
+// push sends the upload to peer. The peer is asked for the offset it has
+// already received first so an interrupted upload only sends the rest.
+func (fs *FileServer) push(peer p2p.Peer, up *upload) error {
+	offset, err := fs.requestUploadOffset(peer, up)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageStoreFile{
+			Key:      up.Replica.Key,
+			ID:       up.id(),
+			Size:     up.Size,
+			Offset:   offset,
+			Checksum: up.Checksum,
+			Meta:     up.Replica,
+		},
+	}
+	// segments are sealed as a whole, so sending resumes by sealing the
+	// segment the offset falls in again and skipping what the peer has
+	hdr, err := parseEncHeader(up.Header)
+	if err != nil {
+		return err
+	}
+	dek, err := hdr.dataKey(fs.keys)
+	if err != nil {
+		return err
+	}
+
+	var (
+		segment, skip int64
+		prefix        []byte
+	)
+	if offset < int64(len(up.Header)) {
+		prefix = up.Header[offset:]
+	} else {
+		segment = (offset - int64(len(up.Header))) / seal.SegmentLength
+		skip = offset - hdr.sealedOffset(segment)
+	}
+
+	_, r, err := fs.store.ReadRange(up.Key, segment*seal.SegmentSize, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	er, err := newEncryptReader(dek, hdr, r, segment)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, er, skip); err != nil {
+		return err
+	}
+
+	//the result is the reply to the upload, no other request may be made
+	//until it was read
+	pc := fs.conn(peer)
+	pc.request.Lock()
+	defer pc.request.Unlock()
+
+	n, err := fs.sendUpload(peer, &msg, prefix, er)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.WaitStream(); err != nil {
+		return err
+	}
+	defer peer.CloseStream()
+
+	result := &uploadResult{}
+	if _, err := readFrame(peer, result); err != nil {
+		return err
+	}
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.Failed != "" {
+		return fmt.Errorf("%s failed storing %s: %s", peer.RemoteAddr(), up.Key, result.Failed)
+	}
+
+	fs.recordReplica(peer, up)
+	log.Printf("[%s] pushed %d bytes of %s to %s from offset %d", fs.Transport.Addr(), n, up.Key, peer.RemoteAddr(), offset)
+	return nil
+}
+
+// sendUpload writes msg followed by the upload, prefix and what is read
+// from r, to peer
+func (fs *FileServer) sendUpload(peer p2p.Peer, msg *Message, prefix []byte, r io.Reader) (int64, error) {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer(p2p.EncodeMessage(msgBuf.Bytes()))
+	buf.WriteByte(p2p.IncomingUpload)
+	buf.Write(prefix)
+
+	pc := fs.conn(peer)
+	pc.write.Lock()
+	defer pc.write.Unlock()
+
+	if err := peer.Send(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return io.Copy(peer, r)
+}
+
+// resumeUploads pushes the uploads that failed earlier to a peer that just
+// (re)connected, uploads left pending for other peers wait for those
+func (fs *FileServer) resumeUploads(peer p2p.Peer) {
+	addr := peer.RemoteAddr().String()
+
+	fs.pendingLock.Lock()
+	pending := make([]*upload, 0, len(fs.pending[addr]))
+	for _, up := range fs.pending[addr] {
+		pending = append(pending, up)
+	}
+	fs.pendingLock.Unlock()
+
+	for _, up := range pending {
+		err := fs.push(peer, up)
+		var quota *QuotaError
+		if err != nil && !errors.As(err, &quota) {
+			log.Printf("[%s] resuming upload of %s to %s: %s", fs.Transport.Addr(), up.Key, peer.RemoteAddr(), err)
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] %s has no room for %s: %s", fs.Transport.Addr(), peer.RemoteAddr(), up.Key, err)
+		}
+
+		fs.pendingLock.Lock()
+		if fs.pending[addr][up.Key] == up {
+			delete(fs.pending[addr], up.Key)
+		}
+		if len(fs.pending[addr]) == 0 {
+			delete(fs.pending, addr)
+		}
+		fs.pendingLock.Unlock()
+	}
+}
+
+// requestUploadOffset asks peer how many bytes of up it already has, a
+// peer without room for up returns a *QuotaError
+func (fs *FileServer) requestUploadOffset(peer p2p.Peer, up *upload) (int64, error) {
+	msg := Message{
+		Payload: MessageGetUploadOffset{
+			Key:  up.Replica.Key,
+			ID:   up.id(),
+			Size: up.Size,
+		},
+	}
+	done, err := fs.request(peer, &msg)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	reply := &uploadOffset{}
+	if _, err := readFrame(peer, reply); err != nil {
+		return 0, err
+	}
+
+	fs.capacityLock.Lock()
+	fs.capacities[peer.RemoteAddr().String()] = reply.Capacity
+	fs.capacityLock.Unlock()
+
+	if reply.Err != nil {
+		return 0, reply.Err
+	}
+	offset := reply.Offset
+	if offset < 0 || offset > up.Size {
+		return 0, fmt.Errorf("peer reported offset %d for a file of %d bytes", offset, up.Size)
+	}
+	return offset, nil
+}
+
+func (fs *FileServer) handleMessageGetUploadOffset(from string, msg MessageGetUploadOffset) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	reply := &uploadOffset{Capacity: fs.store.Capacity()}
+	err := fs.store.CheckQuota(msg.Key, msg.Size)
+	if quota, ok := err.(*QuotaError); ok {
+		reply.Err = quota
+		if werr := fs.sendFrame(peer, reply); werr != nil {
+			return werr
+		}
+		return err
+	}
+	if err == nil {
+		reply.Offset, err = fs.store.StagedOffset(msg.Key, msg.ID, msg.Size)
+	}
+	if err != nil {
+		fs.sendFailure(peer, err)
+		return err
+	}
+	return fs.sendFrame(peer, reply)
+}